@@ -5,50 +5,213 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
-var (
+// defaultClientConfigPath is where the client looks for its configuration
+// file unless BOLT_INVENTORY_CONFIG points somewhere else
+const defaultClientConfigPath = "/etc/bolt/inventory-client.json"
+
+// clientConfig holds the settings used for reaching the inventory service.
+// The settings are read from the optional configuration file and can be
+// overridden through the environment:
+//
+//	BOLT_INVENTORY_URL      the address of the inventory service, either
+//	                        http(s)://host:port or unix:///path/to/socket
+//	BOLT_INVENTORY_TIMEOUT  the timeout of the requests, such as 30s
+//	BOLT_INVENTORY_CA       the PEM file of the CA to verify the service with
+//	BOLT_INVENTORY_TOKEN    the token sent as the bearer authorization
+//	BOLT_INVENTORY_CONFIG   the path of the configuration file
+type clientConfig struct {
+	URL     string
+	Timeout string
+	CA      string
+	Token   string
+}
+
+// loadClientConfig reads the configuration file and applies the overrides
+// from the environment on top of it. The default configuration file is
+// optional, while a file requested through the environment must exist.
+func loadClientConfig() (*clientConfig, error) {
+	config := &clientConfig{URL: "http://localhost:8250", Timeout: "10s"}
+	path := os.Getenv("BOLT_INVENTORY_CONFIG")
+	required := path != ""
+	if !required {
+		path = defaultClientConfigPath
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %s", path, err)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return nil, err
+	}
+	overrides := map[string]*string{
+		"BOLT_INVENTORY_URL":     &config.URL,
+		"BOLT_INVENTORY_TIMEOUT": &config.Timeout,
+		"BOLT_INVENTORY_CA":      &config.CA,
+		"BOLT_INVENTORY_TOKEN":   &config.Token,
+	}
+	for env, setting := range overrides {
+		if value, ok := os.LookupEnv(env); ok {
+			*setting = value
+		}
+	}
+	return config, nil
+}
+
+// client makes the requests to the inventory service
+type client struct {
 	httpClient *http.Client
-)
+	serverURL  string
+	token      string
+}
 
-func init() {
-	// Create a new http client that we can use to make requests to
-	// our inventory server
-	httpClient = &http.Client{
-		Timeout: time.Second * 10,
+// newClient creates the client described by the configuration
+func newClient(config *clientConfig) (*client, error) {
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout %q: %s", config.Timeout, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CA != "" {
+		pem, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
 	}
+	serverURL := strings.TrimRight(config.URL, "/")
+	if strings.HasPrefix(config.URL, "unix://") {
+		// The requests are sent over the socket no matter which host
+		// the URL names
+		socket := strings.TrimPrefix(config.URL, "unix://")
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		serverURL = "http://unix"
+	}
+	return &client{
+		httpClient: &http.Client{Timeout: timeout, Transport: transport},
+		serverURL:  serverURL,
+		token:      config.Token,
+	}, nil
 }
 
-// argProcessor initializes the argument processor to take up the arguments
-// that are being provided as an input to the program
-func argProcessor() {
-	// currently we only listen to the --list argument and don't do
-	// any custom processing using that argument.
+// argProcessor processes the arguments Ansible passes to a dynamic inventory
+// script, which is either --list or --host <hostname>. The data is written
+// to stdout while the errors go to stderr, and the returned value is the
+// exit status of the program.
+func argProcessor(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	list := flags.Bool("list", false, "Print the complete inventory")
+	host := flags.String("host", "", "Print the variables of the host")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !*list && *host == "" {
+		fmt.Fprintln(stderr, "Either --list or --host <hostname> is required")
+		flags.Usage()
+		return 2
+	}
+	config, err := loadClientConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "inventory: %s\n", err)
+		return 1
+	}
+	c, err := newClient(config)
+	if err != nil {
+		fmt.Fprintf(stderr, "inventory: %s\n", err)
+		return 1
+	}
+	if *list {
+		return c.listProcessor(stdout, stderr)
+	}
+	return c.hostProcessor(*host, stdout, stderr)
+}
+
+// listProcessor prints the complete inventory
+func (c *client) listProcessor(stdout io.Writer, stderr io.Writer) int {
+	return c.printResponse("/get/inventory", stdout, stderr)
+}
 
-	args := os.Args
-	if len(args) != 0 {
-		listProcessor()
+// hostProcessor prints the variables of the host
+func (c *client) hostProcessor(hostname string, stdout io.Writer, stderr io.Writer) int {
+	return c.printResponse("/get/host/"+url.PathEscape(hostname), stdout, stderr)
+}
+
+// printResponse requests the path from the inventory service and prints the
+// response. Failures are reported on stderr, so that Ansible never mistakes
+// an error for the inventory.
+func (c *client) printResponse(path string, stdout io.Writer, stderr io.Writer) int {
+	data, err := c.fetch(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "inventory: %s\n", err)
+		return 1
 	}
+	stdout.Write(data)
+	return 0
 }
 
-func listProcessor() {
-	// Make the request to the endpoint to gather the data from inventory
-	resp, err := httpClient.Get("http://localhost:8250/get/inventory")
+// fetch makes the request to the inventory service and returns the body of
+// a successful response
+func (c *client) fetch(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.serverURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		// we had an error, send it back to the client
-		fmt.Fprintf(os.Stdout, "%s", err)
-		return
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", path, resp.Status, errorMessage(data))
+	}
+	return data, nil
+}
+
+// errorMessage returns the message of an error response, falling back to
+// the complete response if it doesn't hold the error envelope
+func errorMessage(data []byte) string {
+	var envelope struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Error.Message == "" {
+		return string(data)
 	}
-	// Read the response and send it back to the output stream
-	data, _ := ioutil.ReadAll(resp.Body)
-	fmt.Fprintf(os.Stdout, "%s", data)
+	return envelope.Error.Message
 }
 
 func main() {
-	argProcessor()
+	os.Exit(argProcessor(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,153 @@
+// Copyrights 2018 Saurabh Badhwar
+// The use of this package is goverened by MIT License
+// which can be found in the LICENSE file.
+
+// The cmd directory holds more than one command, so the tests of the
+// client are run together with its source:
+//
+//	go test inventory.go inventory_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// withConfig points the client to a configuration file with the content
+func withConfig(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "inventory-client.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write the configuration: %s", err)
+	}
+	t.Setenv("BOLT_INVENTORY_CONFIG", path)
+}
+
+// withServer points the client to a test server for the duration of the test
+func withServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	withConfig(t, "{}")
+	t.Setenv("BOLT_INVENTORY_URL", server.URL)
+	return server
+}
+
+func TestArgProcessor(t *testing.T) {
+	withServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/get/inventory":
+			w.Write([]byte(`{"web": {"hosts": ["m1.example.com"]}}`))
+		case "/get/host/m1.example.com":
+			w.Write([]byte(`{"cpus": 4}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Host not found"))
+		}
+	})
+	tests := []struct {
+		args   []string
+		status int
+		stdout string
+	}{
+		{[]string{"--list"}, 0, `{"web": {"hosts": ["m1.example.com"]}}`},
+		{[]string{"--host", "m1.example.com"}, 0, `{"cpus": 4}`},
+		{[]string{"--host", "missing"}, 1, ""},
+		{[]string{}, 2, ""},
+		{[]string{"--unknown"}, 2, ""},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := argProcessor(test.args, &stdout, &stderr)
+		if status != test.status || stdout.String() != test.stdout {
+			t.Errorf("%v: got status %d and output %q", test.args, status, stdout.String())
+		}
+		if status != 0 && stderr.Len() == 0 {
+			t.Errorf("%v: failure was not reported on stderr", test.args)
+		}
+	}
+}
+
+func TestArgProcessorConnectionFailure(t *testing.T) {
+	withConfig(t, "{}")
+	// Nothing listens on the port 1 of the loopback address
+	t.Setenv("BOLT_INVENTORY_URL", "http://127.0.0.1:1")
+	var stdout, stderr bytes.Buffer
+	if status := argProcessor([]string{"--list"}, &stdout, &stderr); status != 1 {
+		t.Errorf("Connection failure returned the status %d", status)
+	}
+	if stdout.Len() != 0 || stderr.Len() == 0 {
+		t.Errorf("Connection failure was printed as the inventory: %q", stdout.String())
+	}
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	withConfig(t, `{"URL": "https://inventory.example.com", "Timeout": "30s", "Token": "secret"}`)
+	t.Setenv("BOLT_INVENTORY_TOKEN", "override")
+	config, err := loadClientConfig()
+	if err != nil {
+		t.Fatalf("Unable to load the configuration: %s", err)
+	}
+	if config.URL != "https://inventory.example.com" || config.Timeout != "30s" {
+		t.Errorf("Configuration file was not applied, got %+v", config)
+	}
+	if config.Token != "override" {
+		t.Errorf("Environment should override the configuration file, got %s", config.Token)
+	}
+	t.Setenv("BOLT_INVENTORY_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := loadClientConfig(); err == nil {
+		t.Errorf("Missing configuration file requested through the environment was ignored")
+	}
+}
+
+func TestClientTLSAndToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(ca, certificate, 0644)
+
+	withConfig(t, "{}")
+	t.Setenv("BOLT_INVENTORY_URL", server.URL)
+	t.Setenv("BOLT_INVENTORY_CA", ca)
+	t.Setenv("BOLT_INVENTORY_TOKEN", "secret")
+	var stdout, stderr bytes.Buffer
+	if status := argProcessor([]string{"--list"}, &stdout, &stderr); status != 0 {
+		t.Errorf("Request over TLS with the token failed: %s", stderr.String())
+	}
+	t.Setenv("BOLT_INVENTORY_CA", "")
+	if status := argProcessor([]string{"--list"}, &stdout, &stderr); status != 1 {
+		t.Errorf("Server certificate was accepted without the CA")
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "inventory.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to listen at the socket: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	withConfig(t, "{}")
+	t.Setenv("BOLT_INVENTORY_URL", "unix://"+socket)
+	var stdout, stderr bytes.Buffer
+	if status := argProcessor([]string{"--list"}, &stdout, &stderr); status != 0 || stdout.String() != "{}" {
+		t.Errorf("Request over the Unix socket failed: %s", stderr.String())
+	}
+}
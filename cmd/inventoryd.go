@@ -5,51 +5,344 @@
 package main
 
 import (
+	"bufio"
 	"flag"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"net/http"
 	"log"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 	inventory "inventory/lib"
 )
 
 // Configuration provides a structure for holding the configuration data
 // for the inventory service.
-type Configuration struct {
-	DataStorePath	string
-	FlushInterval	uint16
-}
+type Configuration = inventory.Config
+
+// defaultListenAddress is used when no address or socket is configured
+const defaultListenAddress = ":8250"
 
 var (
 	configLookupPath  string
+	configRequired	  bool
+	checkConfigOnly	  bool
 	config			  *Configuration
+	shutdownTimeout   time.Duration
+	// listenerFlags holds the flags which override the configuration file
+	listenerFlags	  Configuration
+	hashToken	  bool
+	// currentTLSConfig holds the TLS configuration handed to the new
+	// connections, it is replaced when the certificates are reloaded
+	currentTLSConfig atomic.Value
 )
 
-// ConfigurationParser parses the configuration file 
-func ConfigurationParser() bool {
-	f, ok := os.Open(configLookupPath)
-	if ok != nil {
-		f.Close()
-	} else {
-		json.NewDecoder(f).Decode(&config)
-		f.Close()
-		return true
+// ConfigurationParser parses the configuration file. The default file is
+// optional, while a file passed through -configFile has to exist.
+func ConfigurationParser() error {
+	loaded, err := inventory.LoadConfig(configLookupPath, configRequired)
+	if err != nil {
+		return err
 	}
-	return false
+	config = loaded
+	return nil
 }
 
 // flagParser parses the flags from the command line
 func flagParser() {
 	configPath := flag.String("configFile", "/etc/bolt/inventory.json", "Provide the path where bolt can find its configuration")
+	flag.BoolVar(&checkConfigOnly, "check-config", false, "Validate the configuration and exit")
+	flag.BoolVar(&hashToken, "hashToken", false, "Read a token from stdin, print its hash for the Tokens configuration and exit")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 10*time.Second, "Time to wait for the in-flight requests to finish while shutting down")
+	flag.StringVar(&listenerFlags.ListenAddress, "listenAddress", "", "TCP address to serve the API at, overrides ListenAddress")
+	flag.StringVar(&listenerFlags.UnixSocket, "unixSocket", "", "Unix domain socket to serve the API at, overrides UnixSocket")
+	flag.StringVar(&listenerFlags.TLSCert, "tlsCert", "", "PEM certificate for serving the API over TLS, overrides TLSCert")
+	flag.StringVar(&listenerFlags.TLSKey, "tlsKey", "", "PEM key for serving the API over TLS, overrides TLSKey")
+	flag.StringVar(&listenerFlags.ClientCA, "clientCA", "", "PEM CA to verify the client certificates with, overrides ClientCA")
 
 	flag.Parse()
 	configLookupPath = *configPath
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "configFile" {
+			configRequired = true
+		}
+	})
+}
+
+// checkConfig validates the configuration, including the TLS certificates
+// which are only loaded while listening otherwise
+func checkConfig(config *Configuration) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	_, err := buildTLSConfig(config)
+	return err
+}
+
+// applyFlags overrides the configuration with the flags which were set on
+// the command line
+func applyFlags(config *Configuration) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listenAddress":
+			config.ListenAddress = listenerFlags.ListenAddress
+		case "unixSocket":
+			config.UnixSocket = listenerFlags.UnixSocket
+		case "tlsCert":
+			config.TLSCert = listenerFlags.TLSCert
+		case "tlsKey":
+			config.TLSKey = listenerFlags.TLSKey
+		case "clientCA":
+			config.ClientCA = listenerFlags.ClientCA
+		}
+	})
+}
+
+// buildTLSConfig builds the TLS configuration of the TCP listener. It returns
+// nil if the API is served in plaintext.
+func buildTLSConfig(config *Configuration) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the TLS certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// listen opens the TCP listener and the Unix domain socket the API is
+// served at
+func listen(config *Configuration) ([]net.Listener, error) {
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	address := config.ListenAddress
+	if address == "" && config.UnixSocket == "" {
+		address = defaultListenAddress
+	}
+	var listeners []net.Listener
+	if address != "" {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			// The connections pick up the current configuration, so
+			// that the certificates can be replaced by a reload
+			currentTLSConfig.Store(tlsConfig)
+			l = tls.NewListener(l, &tls.Config{
+				GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+					return currentTLSConfig.Load().(*tls.Config), nil
+				},
+			})
+		}
+		listeners = append(listeners, l)
+	}
+	if config.UnixSocket != "" {
+		// A socket left behind by a service which didn't exit cleanly
+		// would make the listen fail
+		if info, err := os.Lstat(config.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.UnixSocket)
+		}
+		l, err := net.Listen("unix", config.UnixSocket)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// keepRestartSettings reverts the settings which can't change while the
+// service is running to their current values, and warns about them
+func keepRestartSettings(current *Configuration, next *Configuration) {
+	settings := []struct {
+		name    string
+		current *string
+		next    *string
+	}{
+		{"Backend", &current.Backend, &next.Backend},
+		{"BackendPath", &current.BackendPath, &next.BackendPath},
+		{"DataStorePath", &current.DataStorePath, &next.DataStorePath},
+		{"ListenAddress", &current.ListenAddress, &next.ListenAddress},
+		{"UnixSocket", &current.UnixSocket, &next.UnixSocket},
+	}
+	for _, setting := range settings {
+		if *setting.current != *setting.next {
+			inventory.Logf(inventory.LevelWarning, "%s can't change without a restart, keeping %q",
+				setting.name, *setting.current)
+			*setting.next = *setting.current
+		}
+	}
+	// The certificates can be replaced, but the listener can't switch
+	// between plaintext and TLS
+	if (current.TLSCert == "") != (next.TLSCert == "") {
+		inventory.Logf(inventory.LevelWarning, "TLS can't be enabled or disabled without a restart, keeping the TLS settings")
+		next.TLSCert, next.TLSKey, next.ClientCA = current.TLSCert, current.TLSKey, current.ClientCA
+	}
+}
+
+// setLogging applies the log level and format of the configuration, which
+// has been validated already
+func setLogging(config *Configuration) {
+	level, _ := inventory.ParseLogLevel(config.LogLevel)
+	inventory.SetLogLevel(level)
+	format, _ := inventory.ParseLogFormat(config.LogFormat)
+	inventory.SetLogFormat(format)
+}
+
+// reloadConfig reads the configuration again and applies the settings which
+// can change while the API is being served. The running configuration is
+// kept if the new one is invalid.
+func reloadConfig() error {
+	next, err := inventory.LoadConfig(configLookupPath, configRequired)
+	if err != nil {
+		return err
+	}
+	applyFlags(next)
+	keepRestartSettings(config, next)
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := buildTLSConfig(next)
+	if err != nil {
+		return err
+	}
+	if err := inventory.APIReload(next.Options()); err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		currentTLSConfig.Store(tlsConfig)
+	}
+	setLogging(next)
+	config = next
+	return nil
+}
+
+// serve runs the API server until it fails or the service is asked to
+// terminate through SIGTERM or SIGINT. On termination, the server stops
+// accepting connections and waits for the in-flight requests before the
+// inventory is written to the datastore. SIGHUP reloads the configuration
+// without interrupting the server. The returned value is the exit status
+// of the service.
+func serve(server *http.Server, listeners []net.Listener) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	serverErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			serverErr <- server.Serve(l)
+		}(l)
+	}
+
+	status := 0
+	for stopped := false; !stopped; {
+		select {
+		case err := <-serverErr:
+			inventory.Logf(inventory.LevelError, "Unable to serve the API: %s", err)
+			server.Close()
+			status = 1
+			stopped = true
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				inventory.Logf(inventory.LevelInfo, "Received %s, reloading the configuration", sig)
+				if err := reloadConfig(); err != nil {
+					inventory.Logf(inventory.LevelError, "Unable to reload the configuration, keeping the current one: %s", err)
+				} else {
+					inventory.Logf(inventory.LevelInfo, "Configuration reloaded")
+				}
+				continue
+			}
+			inventory.Logf(inventory.LevelInfo, "Received %s, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := server.Shutdown(ctx); err != nil {
+				inventory.Logf(inventory.LevelError, "Unable to drain the in-flight requests: %s", err)
+				status = 1
+			}
+			cancel()
+			stopped = true
+		}
+	}
+	// The changes acknowledged so far are written to the datastore even if
+	// the server failed, they would otherwise only live in the operation log
+	if err := inventory.APIStop(); err != nil {
+		inventory.Logf(inventory.LevelError, "Unable to write the inventory to the datastore: %s", err)
+		status = 1
+	}
+	return status
 }
 
 func main() {
 	flagParser()
-	ConfigurationParser()
-	api := inventory.APIInit(config.DataStorePath, config.FlushInterval)
+	if hashToken {
+		// The token is read from stdin so that it doesn't show up in the
+		// process list or the shell history
+		token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Unable to read the token: %s", err)
+		}
+		fmt.Println(inventory.HashToken(strings.TrimSpace(token)))
+		return
+	}
+	if err := ConfigurationParser(); err != nil {
+		fmt.Fprintf(os.Stderr, "inventoryd: %s\n", err)
+		os.Exit(1)
+	}
+	applyFlags(config)
+	if err := checkConfig(config); err != nil {
+		fmt.Fprintf(os.Stderr, "inventoryd: invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
+	if checkConfigOnly {
+		fmt.Println("Configuration OK")
+		return
+	}
 	log.SetOutput(os.Stdout)
-	log.Fatal(http.ListenAndServe(":8250", api))
-}
\ No newline at end of file
+	setLogging(config)
+	listeners, err := listen(config)
+	if err != nil {
+		inventory.Logf(inventory.LevelError, "Unable to listen for the API requests: %s", err)
+		os.Exit(1)
+	}
+	api, err := inventory.APIInit(config.Options())
+	if err != nil {
+		inventory.Logf(inventory.LevelError, "Unable to start the inventory: %s", err)
+		for _, l := range listeners {
+			l.Close()
+		}
+		os.Exit(1)
+	}
+	os.Exit(serve(&http.Server{Handler: api}, listeners))
+}
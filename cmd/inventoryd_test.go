@@ -0,0 +1,278 @@
+// Copyrights 2018 Saurabh Badhwar
+// The use of this package is governed by MIT license
+// which can be found in the LICENSE file.
+
+// The cmd directory holds more than one command, so the tests of the
+// service are run together with its source:
+//
+//	go test inventoryd.go inventoryd_test.go
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	inventory "inventory/lib"
+)
+
+// TestMain runs the service itself when the test binary is started as the
+// daemon by one of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("INVENTORYD_TEST_DAEMON") == "1" {
+		os.Args = append(os.Args[:1], strings.Fields(os.Getenv("INVENTORYD_TEST_ARGS"))...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// freeAddress returns a loopback address with a port nothing listens on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// writeConfig writes the configuration into the directory
+func writeConfig(t *testing.T, dir string, config Configuration) string {
+	configPath := filepath.Join(dir, "inventory.json")
+	data, _ := json.Marshal(config)
+	if err := ioutil.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatalf("Unable to write the configuration: %s", err)
+	}
+	return configPath
+}
+
+// daemonCommand returns the command running the service with the arguments
+func daemonCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(),
+		"INVENTORYD_TEST_DAEMON=1",
+		"INVENTORYD_TEST_ARGS="+strings.Join(args, " "),
+	)
+	return cmd
+}
+
+// startDaemon starts the service with the configuration and the extra
+// arguments, and waits for it to answer the requests made by the client
+// at the base URL.
+func startDaemon(t *testing.T, config Configuration, client *http.Client, baseURL string, args ...string) *exec.Cmd {
+	return startDaemonWithConfigFile(t, writeConfig(t, t.TempDir(), config), client, baseURL, args...)
+}
+
+// startDaemonWithConfigFile starts the service like startDaemon, but with
+// an existing configuration file
+func startDaemonWithConfigFile(t *testing.T, configPath string, client *http.Client, baseURL string, args ...string) *exec.Cmd {
+	cmd := daemonCommand(append([]string{"-configFile", configPath}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Unable to start the service: %s", err)
+	}
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	})
+	for i := 0; i < 50; i++ {
+		if resp, err := client.Get(baseURL + "/ping"); err == nil {
+			resp.Body.Close()
+			return cmd
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Service didn't start answering the requests")
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dataStorePath := filepath.Join(t.TempDir(), "data.db")
+	address := freeAddress(t)
+	// The flush interval is long enough for the write to only reach the
+	// datastore through the shutdown
+	config := Configuration{DataStorePath: dataStorePath, FlushInterval: 60000, ListenAddress: address}
+	cmd := startDaemon(t, config, http.DefaultClient, "http://"+address)
+	resp, err := http.Post("http://"+address+"/create/hostgroup", "application/json",
+		strings.NewReader(`{"hostgroup": "web"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unable to create the hostgroup: %v", err)
+	}
+	resp.Body.Close()
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Service didn't exit cleanly: %s", err)
+	}
+	data, err := ioutil.ReadFile(dataStorePath)
+	if err != nil {
+		t.Fatalf("Unable to read the datastore: %s", err)
+	}
+	var stored struct {
+		Hostgroups map[string]interface{}
+	}
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Hostgroups["web"] == nil {
+		t.Errorf("Last write is missing from the datastore, got %s", data)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "inventory.sock")
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+	config := Configuration{DataStorePath: filepath.Join(dir, "data.db"), FlushInterval: 1000, UnixSocket: socket}
+	cmd := startDaemon(t, config, client, "http://unix")
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Service didn't exit cleanly: %s", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket was left behind after the shutdown")
+	}
+}
+
+// writeCertificate writes a self-signed certificate for the loopback address
+// along with its key, and returns the certificate for building the clients.
+func writeCertificate(t *testing.T, certPath string, keyPath string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate the key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "inventory"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create the certificate: %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ioutil.WriteFile(certPath, certPEM, 0644)
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	certificate, _ := tls.X509KeyPair(certPEM, keyPEM)
+	return certificate
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	certificate := writeCertificate(t, certPath, keyPath)
+	leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{certificate},
+	}}}
+	address := freeAddress(t)
+	config := Configuration{DataStorePath: filepath.Join(dir, "data.db"), FlushInterval: 1000}
+	// The listener settings are passed as flags on the command line
+	startDaemon(t, config, client, "https://"+address, "-listenAddress", address,
+		"-tlsCert", certPath, "-tlsKey", keyPath, "-clientCA", certPath)
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := anonymous.Get("https://" + address + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Client without a certificate was accepted")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := Configuration{DataStorePath: filepath.Join(dir, "data.db"), FlushInterval: 1000}
+	invalid := Configuration{DataStorePath: filepath.Join(dir, "data.db")}
+	missing := filepath.Join(dir, "missing.json")
+	tests := []struct {
+		configPath string
+		success    bool
+	}{
+		{writeConfig(t, t.TempDir(), valid), true},
+		{writeConfig(t, t.TempDir(), invalid), false},
+		{missing, false},
+	}
+	for _, test := range tests {
+		output, err := daemonCommand("-configFile", test.configPath, "--check-config").CombinedOutput()
+		if (err == nil) != test.success {
+			t.Errorf("%s: unexpected result %v: %s", test.configPath, err, output)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.db")); !os.IsNotExist(err) {
+		t.Errorf("Checking the configuration created the datastore")
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	address := freeAddress(t)
+	config := Configuration{
+		DataStorePath: filepath.Join(dir, "data.db"),
+		FlushInterval: 1000,
+		ListenAddress: address,
+		Tokens:        []inventory.Token{{Name: "old", Hash: inventory.HashToken("old-token"), Role: inventory.RoleReader}},
+	}
+	cmd := startDaemonWithConfigFile(t, writeConfig(t, dir, config), http.DefaultClient, "http://"+address)
+	status := func(token string) int {
+		req, _ := http.NewRequest("GET", "http://"+address+"/get/inventory", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Service stopped answering the requests: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	config.Tokens = []inventory.Token{{Name: "new", Hash: inventory.HashToken("new-token"), Role: inventory.RoleReader}}
+	// The datastore can't be moved while the service is running
+	config.DataStorePath = filepath.Join(dir, "moved.db")
+	writeConfig(t, dir, config)
+	cmd.Process.Signal(syscall.SIGHUP)
+	for i := 0; i < 50 && status("new-token") != http.StatusOK; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status("new-token") != http.StatusOK || status("old-token") != http.StatusUnauthorized {
+		t.Errorf("Tokens were not replaced by the reload")
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Service didn't exit cleanly: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved.db")); !os.IsNotExist(err) {
+		t.Errorf("DataStorePath was changed by the reload")
+	}
+}
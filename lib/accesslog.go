@@ -0,0 +1,96 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader carries the ID of a request. An ID sent by the client is
+// kept, otherwise one is generated. Either way it is returned inside the
+// response and recorded inside the access log.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the IDs accepted from the clients
+const maxRequestIDLength = 128
+
+// requestInfo collects the details of a request which are only known once
+// it has been handled
+type requestInfo struct {
+	id       string
+	identity string
+}
+
+type requestInfoKey struct{}
+
+// RequestID returns the ID of the request being served by the API, or an
+// empty string outside of a request
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// setIdentity records who made the request, for the access log
+func setIdentity(r *http.Request, identity string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.identity = identity
+	}
+}
+
+// accessLog records every request along with its ID, which is taken from
+// the X-Request-ID header or generated
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		info := &requestInfo{id: id}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			info.identity = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		s.logger.Log(LevelInfo, "request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(start))/float64(time.Millisecond),
+			"client", r.RemoteAddr,
+			"identity", info.identity,
+		)
+	})
+}
+
+// validRequestID checks that the ID sent by a client is safe to be logged
+// and returned
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,90 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer collects the log records written by the concurrent requests
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Record is not JSON: %s, got %q", err, line)
+		}
+		if record["msg"] == "request" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	var out syncBuffer
+	server := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{
+		Tokens: []Token{{Name: "ci", Hash: HashToken("token"), Role: RoleReader}},
+		Logger: NewLogger(&out, FormatJSON, LevelInfo),
+	})
+	request := func(method string, path string, token string, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"hostgroup": "web"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := request("GET", "/get/inventory", "token", "abc-123"); rec.Header().Get(RequestIDHeader) != "abc-123" {
+		t.Errorf("Request ID of the client was not returned, got %q", rec.Header().Get(RequestIDHeader))
+	}
+	generated := request("POST", "/create/hostgroup", "token", "bad id\n").Header().Get(RequestIDHeader)
+	if generated == "" || generated == "bad id\n" {
+		t.Errorf("Request ID was not generated, got %q", generated)
+	}
+	request("GET", "/get/everything", "", "")
+
+	records := out.records(t)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 access log records, got %d", len(records))
+	}
+	expected := []map[string]interface{}{
+		{"request_id": "abc-123", "method": "GET", "path": "/get/inventory", "status": 200.0, "identity": "ci"},
+		{"request_id": generated, "method": "POST", "path": "/create/hostgroup", "status": 403.0, "identity": "ci"},
+		{"method": "GET", "path": "/get/everything", "status": 404.0, "identity": ""},
+	}
+	for i, want := range expected {
+		for key, value := range want {
+			if records[i][key] != value {
+				t.Errorf("Record %d has %s %v, expected %v", i, key, records[i][key], value)
+			}
+		}
+		if _, ok := records[i]["duration_ms"]; !ok || records[i]["client"] == "" {
+			t.Errorf("Record %d is missing the duration or the client, got %v", i, records[i])
+		}
+	}
+}
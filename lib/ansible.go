@@ -0,0 +1,95 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import "sort"
+
+// GetAnsibleInventory renders the complete inventory in the format which
+// Ansible expects from a dynamic inventory script. The rendering happens
+// under a single read lock so that the hostgroups, hosts and their facts
+// are consistent with each other.
+func (inv *Inventory) GetAnsibleInventory() map[string]interface{} {
+	inv.RLock()
+	defer inv.RUnlock()
+	hostvars := make(map[string]interface{})
+	outputInvMap := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": hostvars},
+	}
+	for hgname, hostgroup := range inv.Hostgroups {
+		outputInvMap[hgname] = map[string]interface{}{
+			"hosts":    sortedHostnames(hostgroup.Hosts),
+			"vars":     copyValues(hostgroup.Vars),
+			"children": append(make([]string, 0, len(hostgroup.Children)), hostgroup.Children...),
+		}
+		for hostname, host := range hostgroup.Hosts {
+			hostvars[hostname] = copyValues(host.Facts)
+		}
+	}
+	// Hosts which were removed from all of their hostgroups are still part of
+	// the inventory, Ansible expects such hosts under the ungrouped group.
+	if ungrouped := inv.ungroupedHosts(); len(ungrouped) > 0 {
+		if _, ok := outputInvMap["ungrouped"]; !ok {
+			outputInvMap["ungrouped"] = map[string]interface{}{"hosts": ungrouped}
+		}
+		for _, hostname := range ungrouped {
+			hostvars[hostname] = copyValues(inv.Hosts[hostname].Facts)
+		}
+	}
+	return outputInvMap
+}
+
+// GetAnsibleHostgroup renders a single hostgroup in the format Ansible uses
+// for describing a group. Since the group is served on its own, the variables
+// inherited from the parent hostgroups are folded into the group vars. If the
+// hostgroup doesn't exists, the call returns nil.
+func (inv *Inventory) GetAnsibleHostgroup(hgname string) map[string]interface{} {
+	inv.RLock()
+	defer inv.RUnlock()
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"hosts":    sortedHostnames(hostgroup.Hosts),
+		"vars":     inv.hostgroupVars(hgname),
+		"children": append(make([]string, 0, len(hostgroup.Children)), hostgroup.Children...),
+	}
+}
+
+// GetAnsibleHostVars renders the variables of a single host, as Ansible
+// expects them from a dynamic inventory script called with --host. The
+// variables of all the hostgroups of the host, including the inherited
+// ones, are merged in the order of the Ansible precedence and the facts of
+// the host take precedence over all of them. If the host doesn't exists,
+// the call returns nil.
+func (inv *Inventory) GetAnsibleHostVars(hostname string) map[string]interface{} {
+	inv.RLock()
+	defer inv.RUnlock()
+	host := inv.getHost(hostname)
+	if host == nil {
+		return nil
+	}
+	var hgnames []string
+	for hgname, hostgroup := range inv.Hostgroups {
+		if _, ok := hostgroup.Hosts[hostname]; ok {
+			hgnames = append(hgnames, hgname)
+		}
+	}
+	vars := inv.lineageVars(hgnames)
+	for fname, fval := range copyValues(host.Facts) {
+		vars[fname] = fval
+	}
+	return vars
+}
+
+// sortedHostnames returns the names of the hosts in a stable order
+func sortedHostnames(hosts map[string]*Host) []string {
+	hostnames := make([]string, 0, len(hosts))
+	for hostname := range hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
@@ -5,29 +5,58 @@
 package inventory
 
 import (
-	"github.com/gorilla/mux"
+	"fmt"
 )
 
+// apiServer is the server set up by APIInit. Services embedding the
+// inventory create their own servers through NewServer instead.
+var apiServer *Server
+
 // APIInit initializes the API service using the mux router
-// engine and maps the endpoints to the required call handlers
-func APIInit(dataStorePath string, flushInterval uint16) *mux.Router {
-	// Setup the inventory before we can use the router
-	setupInventory(dataStorePath, flushInterval)
-	// We are good to go with a new router
-	router := mux.NewRouter()
-	// Register the handlers here
-	router.HandleFunc("/ping", ping).Methods("GET")
-	router.HandleFunc("/create/hostgroup", createHostgroup).Methods("POST")
-	router.HandleFunc("/create/host", createHost).Methods("POST")
-	router.HandleFunc("/create/fact", setHostFact).Methods("POST")
-	router.HandleFunc("/get/inventory", getInventory).Methods("GET")
-	router.HandleFunc("/get/hosts/{hostgroup}", getHosts).Methods("GET")
-	return router
+// engine and maps the endpoints to the required call handlers.
+// The inventory is opened with the options and is served by a
+// server which is kept by the package, see NewServer for serving
+// more than one inventory.
+func APIInit(opts Options) (*Server, error) {
+	if _, err := newAuthenticator(opts.Tokens); err != nil {
+		return nil, fmt.Errorf("invalid token configuration: %s", err)
+	}
+	// Setup the inventory before we can serve it
+	inv, err := Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	server, err := NewServer(inv, ServerOptions{Tokens: opts.Tokens})
+	if err != nil {
+		inv.Close()
+		return nil, err
+	}
+	apiServer = server
+	return server, nil
 }
 
-// setupInventory initializes the inventory variable which is then
-// used by the API to actually run the inventory service
-func setupInventory(dataStorePath string, flushInterval uint16) {
-	inv = NewInventory(dataStorePath, flushInterval)
+// APIReload applies the settings which can change while the API is being
+// served: the tokens, the flush interval and threshold and the limit of
+// the pending operations. The remaining options are ignored. Invalid
+// tokens are rejected before anything is changed.
+func APIReload(opts Options) error {
+	if apiServer == nil {
+		return fmt.Errorf("the API is not initialized")
+	}
+	if err := apiServer.SetTokens(opts.Tokens); err != nil {
+		return err
+	}
+	apiServer.inv.SetFlushSettings(opts.FlushInterval, opts.FlushThreshold)
+	apiServer.inv.SetMaxPendingOps(opts.MaxPendingOps)
+	return nil
 }
 
+// APIStop stops the inventory service once the API no longer serves any
+// requests. The pending operations are written to the datastore before
+// the call returns, the error reports a failed write.
+func APIStop() error {
+	if apiServer == nil {
+		return nil
+	}
+	return apiServer.inv.Close()
+}
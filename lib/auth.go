@@ -0,0 +1,329 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// The roles which can be granted to a token. Every role includes the
+// permissions of the roles before it.
+const (
+	// RoleReader allows the GET requests
+	RoleReader = "reader"
+	// RoleWriter additionally allows creating and updating through the POST requests
+	RoleWriter = "writer"
+	// RoleAdmin additionally allows the DELETE requests
+	RoleAdmin = "admin"
+)
+
+// roleLevels orders the roles by the permissions they grant
+var roleLevels = map[string]int{RoleReader: 1, RoleWriter: 2, RoleAdmin: 3}
+
+// Token grants access to the API to the clients presenting it as a bearer
+// token. Only the hash of the token is kept in the configuration.
+type Token struct {
+	// Name identifies the token inside the logs
+	Name string `yaml:"Name"`
+	// Hash is the hex encoded SHA-256 hash of the token, see HashToken
+	Hash string `yaml:"Hash"`
+	// Role is one of reader, writer or admin
+	Role string `yaml:"Role"`
+	// Hostgroups limits the token to the requests about these hostgroups.
+	// A token without hostgroups can access the complete inventory.
+	Hostgroups []string `yaml:"Hostgroups"`
+}
+
+// HashToken returns the hash under which the token is configured
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticator authorizes the API requests against the configured tokens.
+// The tokens can be replaced while the requests are being served.
+type authenticator struct {
+	sync.RWMutex
+	tokens map[string]Token
+	// pingPath is the path of the ping endpoint, which stays open
+	pingPath string
+	// logger receives the denied requests
+	logger *Logger
+	// inv is the inventory served by the API. The memberships of its hosts
+	// decide whether a scoped token can reach them.
+	inv *Inventory
+}
+
+// newAuthenticator validates the tokens and indexes them by their hashes
+func newAuthenticator(tokens []Token) (*authenticator, error) {
+	indexed, err := indexTokens(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &authenticator{tokens: indexed, pingPath: "/ping", logger: defaultLogger}, nil
+}
+
+// indexTokens validates the tokens and indexes them by their hashes
+func indexTokens(tokens []Token) (map[string]Token, error) {
+	indexed := make(map[string]Token, len(tokens))
+	for _, token := range tokens {
+		if _, ok := roleLevels[token.Role]; !ok {
+			return nil, fmt.Errorf("token %s has the unknown role %q", token.Name, token.Role)
+		}
+		hash := strings.ToLower(token.Hash)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("token %s doesn't have a valid SHA-256 hash", token.Name)
+		}
+		indexed[hash] = token
+	}
+	return indexed, nil
+}
+
+// setTokens replaces the tokens. Invalid tokens leave the current ones in
+// place.
+func (auth *authenticator) setTokens(tokens []Token) error {
+	indexed, err := indexTokens(tokens)
+	if err != nil {
+		return err
+	}
+	auth.Lock()
+	auth.tokens = indexed
+	auth.Unlock()
+	return nil
+}
+
+// lookup returns the token with the hash and whether any tokens are
+// configured at all
+func (auth *authenticator) lookup(hash string) (Token, bool, bool) {
+	auth.RLock()
+	defer auth.RUnlock()
+	token, ok := auth.tokens[hash]
+	return token, ok, len(auth.tokens) > 0
+}
+
+// requiredRole returns the role needed for the request method
+func requiredRole(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return RoleReader
+	case http.MethodDelete:
+		return RoleAdmin
+	}
+	return RoleWriter
+}
+
+// middleware rejects the requests which don't carry a token allowed to make
+// them. The ping endpoint stays open for the health checks, and without any
+// tokens the complete API is open.
+func (auth *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if path, _ := route.GetPathTemplate(); path == auth.pingPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		header := r.Header.Get("Authorization")
+		token, ok, enabled := auth.lookup(HashToken(strings.TrimPrefix(header, "Bearer ")))
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "authorization token required", "")
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "invalid authorization token", "")
+			return
+		}
+		setIdentity(r, token.Name)
+		if roleLevels[token.Role] < roleLevels[requiredRole(r.Method)] {
+			auth.logger.Log(LevelInfo, "request denied by the role of the token",
+				"request_id", RequestID(r.Context()), "token", token.Name, "role", token.Role, "method", r.Method, "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, errCodeForbidden, "token not allowed to make the request", "")
+			return
+		}
+		if len(token.Hostgroups) > 0 {
+			allowed, err := auth.inScope(token, r)
+			if err != nil && isBodyTooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", maxRequestBodySize), "")
+				return
+			}
+			if !allowed {
+				auth.logger.Log(LevelInfo, "request denied outside of the hostgroups of the token",
+					"request_id", RequestID(r.Context()), "token", token.Name, "method", r.Method, "path", r.URL.Path)
+				writeError(w, http.StatusForbidden, errCodeForbidden, "token not allowed to access the hostgroup", "")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inScope checks that the request is about the hostgroups of the token.
+// Requests which don't name a hostgroup, such as the complete inventory,
+// are outside of every scope, and so are the requests which reach hosts
+// that also belong to hostgroups outside of the scope. The variables of a
+// host can only be read if all of its hostgroups are in the scope. The
+// error reports a body which couldn't be read.
+func (auth *authenticator) inScope(token Token, r *http.Request) (bool, error) {
+	hostgroups, hostname, err := requestTargets(r)
+	if err != nil {
+		return false, err
+	}
+	if len(hostgroups) == 0 {
+		if hostname == "" || r.Method != http.MethodGet {
+			return false, nil
+		}
+		return !auth.hostOutOfScope(token, hostname), nil
+	}
+	for _, hgname := range hostgroups {
+		if !inHostgroups(hgname, token.Hostgroups) {
+			return false, nil
+		}
+	}
+	return !auth.reachesOutOfScope(token, r, hostgroups[0], hostname), nil
+}
+
+// inHostgroups reports whether the hostgroup is one of the hostgroups
+func inHostgroups(hgname string, hostgroups []string) bool {
+	for _, name := range hostgroups {
+		if hgname == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reachesOutOfScope reports whether the request reaches a host which also
+// belongs to a hostgroup outside of the scope of the token. A host and its
+// facts are shared by all of its hostgroups, so adding such a host to a
+// scoped hostgroup, reading its facts through the hostgroup or changing
+// them would reach into the other hostgroups. Removing the host from a
+// scoped hostgroup is still allowed. The Ansible format of a hostgroup
+// renders the variables inherited from its parents, which all need to be
+// in the scope as well.
+func (auth *authenticator) reachesOutOfScope(token Token, r *http.Request, hgname string, hostname string) bool {
+	if auth.inv == nil {
+		return false
+	}
+	auth.inv.RLock()
+	defer auth.inv.RUnlock()
+	var hostnames []string
+	switch {
+	case hostname != "":
+		if r.Method == http.MethodDelete && mux.Vars(r)["fact"] == "" {
+			return false
+		}
+		hostnames = []string{hostname}
+	case r.Method == http.MethodGet && r.URL.Query().Get("format") == "ansible":
+		return lineageOutOfScope(token, []string{hgname}, auth.inv.parentIndex())
+	case r.Method == http.MethodGet:
+		// The hosts of the hostgroup are listed along with their facts
+		if hostgroup := auth.inv.getHostgroup(hgname); hostgroup != nil {
+			for name := range hostgroup.Hosts {
+				hostnames = append(hostnames, name)
+			}
+		}
+	}
+	for _, name := range hostnames {
+		for _, member := range auth.inv.hostgroupNames(name) {
+			if !inHostgroups(member, token.Hostgroups) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostOutOfScope reports whether the variables of the host reach outside of
+// the scope of the token. They are merged from all the hostgroups of the
+// host along with their parents, and a host without a hostgroup isn't part
+// of any scope.
+func (auth *authenticator) hostOutOfScope(token Token, hostname string) bool {
+	if auth.inv == nil {
+		return true
+	}
+	auth.inv.RLock()
+	defer auth.inv.RUnlock()
+	hostgroups := auth.inv.hostgroupNames(hostname)
+	if len(hostgroups) == 0 {
+		return true
+	}
+	return lineageOutOfScope(token, hostgroups, auth.inv.parentIndex())
+}
+
+// lineageOutOfScope reports whether any of the hostgroups or their
+// ancestors is outside of the scope of the token
+func lineageOutOfScope(token Token, hostgroups []string, parents map[string][]string) bool {
+	lineage := append([]string{}, hostgroups...)
+	seen := make(map[string]bool, len(hostgroups))
+	for i := 0; i < len(lineage); i++ {
+		if seen[lineage[i]] {
+			continue
+		}
+		seen[lineage[i]] = true
+		if !inHostgroups(lineage[i], token.Hostgroups) {
+			return true
+		}
+		lineage = append(lineage, parents[lineage[i]]...)
+	}
+	return false
+}
+
+// requestTargets returns the hostgroups and the host the request is about,
+// either from the path or from the JSON body. The body is restored for the
+// handler.
+func requestTargets(r *http.Request) ([]string, string, error) {
+	vars := mux.Vars(r)
+	if hgname, ok := vars["hostgroup"]; ok {
+		hostgroups := []string{hgname}
+		if child, ok := vars["child"]; ok {
+			hostgroups = append(hostgroups, child)
+		}
+		return hostgroups, vars["hostname"], nil
+	}
+	if hostname, ok := vars["hostname"]; ok {
+		return nil, hostname, nil
+	}
+	if r.Body == nil || r.Method != http.MethodPost {
+		return nil, "", nil
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	r.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	var params map[string]interface{}
+	if err := decodeJSON(data, &params); err != nil {
+		return nil, "", err
+	}
+	var hostgroups []string
+	for _, key := range []string{"hostgroup", "child"} {
+		if value, ok := params[key]; ok {
+			hgname, ok := value.(string)
+			if !ok {
+				return nil, "", fmt.Errorf("%s is not a string", key)
+			}
+			hostgroups = append(hostgroups, hgname)
+		}
+	}
+	hostname, _ := params["hostname"].(string)
+	return hostgroups, hostname, nil
+}
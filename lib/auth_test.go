@@ -0,0 +1,203 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokenAuthorization(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{
+		Tokens: []Token{
+			{Name: "reader", Hash: HashToken("reader-token"), Role: RoleReader},
+			{Name: "writer", Hash: HashToken("writer-token"), Role: RoleWriter},
+			{Name: "admin", Hash: HashToken("admin-token"), Role: RoleAdmin},
+			{Name: "ci", Hash: HashToken("ci-token"), Role: RoleAdmin, Hostgroups: []string{"ci"}},
+		},
+	})
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", "GET", "/ping", "", http.StatusOK},
+		{"", "GET", "/get/inventory", "", http.StatusUnauthorized},
+		{"unknown-token", "GET", "/get/inventory", "", http.StatusUnauthorized},
+		{"reader-token", "GET", "/get/inventory", "", http.StatusOK},
+		{"reader-token", "POST", "/create/hostgroup", `{"hostgroup": "web"}`, http.StatusForbidden},
+		{"writer-token", "POST", "/create/hostgroup", `{"hostgroup": "web"}`, http.StatusCreated},
+		{"writer-token", "DELETE", "/delete/hostgroup/web", "", http.StatusForbidden},
+		{"admin-token", "DELETE", "/delete/hostgroup/web", "", http.StatusOK},
+		{"ci-token", "POST", "/create/host", `{"hostgroup": "ci", "hostname": "m1"}`, http.StatusCreated},
+		{"ci-token", "POST", "/create/host", `{"hostgroup": "web", "hostname": "m1"}`, http.StatusForbidden},
+		{"ci-token", "POST", "/create/fact", `{"hostname": "m1", "cpus": 4}`, http.StatusForbidden},
+		{"ci-token", "POST", "/create/fact", `{"hostgroup": "ci", "hostname": "m1", "cpus": 4}`, http.StatusCreated},
+		{"ci-token", "GET", "/get/hosts/ci", "", http.StatusOK},
+		{"ci-token", "GET", "/get/inventory", "", http.StatusForbidden},
+		{"ci-token", "DELETE", "/delete/host/m1", "", http.StatusForbidden},
+		{"ci-token", "DELETE", "/delete/host/ci/m1", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s %s with %q: got %d, want %d", test.method, test.path, test.token, rec.Code, test.status)
+		}
+	}
+}
+
+func TestScopedTokenSharedHosts(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{
+		Tokens: []Token{
+			{Name: "admin", Hash: HashToken("admin-token"), Role: RoleAdmin},
+			{Name: "ci", Hash: HashToken("ci-token"), Role: RoleAdmin, Hostgroups: []string{"ci"}},
+		},
+	})
+	inventory := router.Inventory()
+	inventory.NewHost("prod", "db1")
+	inventory.SetHostFacts("prod", "db1", map[string]interface{}{"db_password": "secret", "ansible_host": "10.0.0.1"})
+	inventory.NewHost("ci", "ci01")
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		// A host of another hostgroup can't be pulled into the scope
+		{"ci-token", "POST", "/create/host", `{"hostgroup": "ci", "hostname": "db1"}`, http.StatusForbidden},
+		{"ci-token", "POST", "/create/membership", `{"hostgroup": "ci", "hostname": "db1"}`, http.StatusForbidden},
+		{"ci-token", "POST", "/create/host", `{"hostgroup": "ci", "hostname": "ci02"}`, http.StatusCreated},
+		{"ci-token", "POST", "/create/membership", `{"hostgroup": "ci", "hostname": "ci02"}`, http.StatusCreated},
+		// Once the host is shared, its facts stay out of reach
+		{"admin-token", "POST", "/create/membership", `{"hostgroup": "ci", "hostname": "db1"}`, http.StatusCreated},
+		{"ci-token", "GET", "/get/hosts/ci", "", http.StatusForbidden},
+		{"ci-token", "GET", "/get/hosts/ci?format=ansible", "", http.StatusOK},
+		{"ci-token", "POST", "/create/fact", `{"hostgroup": "ci", "hostname": "db1", "ansible_host": "evil"}`, http.StatusForbidden},
+		{"ci-token", "DELETE", "/delete/fact/ci/db1/db_password", "", http.StatusForbidden},
+		{"ci-token", "POST", "/create/fact", `{"hostgroup": "ci", "hostname": "ci01", "cpus": 4}`, http.StatusCreated},
+		// The shared host can still be removed from the scoped hostgroup
+		{"ci-token", "DELETE", "/delete/membership/ci/db1", "", http.StatusOK},
+		{"ci-token", "GET", "/get/hosts/ci", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s %s %s with %q: got %d, want %d", test.method, test.path, test.body, test.token, rec.Code, test.status)
+		}
+	}
+	vars := inventory.GetAnsibleHostVars("db1")
+	if vars["ansible_host"] != "10.0.0.1" || vars["db_password"] != "secret" {
+		t.Errorf("Facts of the shared host were changed, got %v", vars)
+	}
+	if hostgroups := inventory.GetHostgroupNames("db1"); len(hostgroups) != 1 || hostgroups[0] != "prod" {
+		t.Errorf("Shared host was not removed from the scoped hostgroup, got %v", hostgroups)
+	}
+}
+
+func TestScopedTokenInheritedVars(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{
+		Tokens: []Token{
+			{Name: "ci", Hash: HashToken("ci-token"), Role: RoleReader, Hostgroups: []string{"ci", "ci-web"}},
+		},
+	})
+	inventory := router.Inventory()
+	inventory.NewHost("ci", "ci01")
+	inventory.NewHost("ci-web", "web01")
+	inventory.NewHostgroup("prod")
+	inventory.SetHostgroupVar("prod", "db_password", "secret")
+	inventory.AddChildHostgroup("ci", "ci-web")
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/get/hosts/ci-web?format=ansible", http.StatusOK},
+		{"/get/host/web01", http.StatusOK},
+		{"/get/host/ci01", http.StatusOK},
+		{"/get/host/missing", http.StatusForbidden},
+	}
+	check := func() {
+		for _, test := range tests {
+			req := httptest.NewRequest("GET", test.path, nil)
+			req.Header.Set("Authorization", "Bearer ci-token")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("GET %s: got %d, want %d", test.path, rec.Code, test.status)
+			}
+			if strings.Contains(rec.Body.String(), "secret") {
+				t.Errorf("GET %s leaked the variables of an out of scope hostgroup", test.path)
+			}
+		}
+	}
+	check()
+
+	// Once a hostgroup outside of the scope becomes a parent, the variables
+	// it passes down stay out of reach
+	inventory.AddChildHostgroup("prod", "ci-web")
+	tests[0].status = http.StatusForbidden
+	tests[1].status = http.StatusForbidden
+	check()
+}
+
+func TestReloadTokens(t *testing.T) {
+	router, err := APIInit(Options{
+		DataStorePath: testDataStorePath(t),
+		FlushInterval: 60000,
+		Tokens:        []Token{{Name: "old", Hash: HashToken("old-token"), Role: RoleReader}},
+	})
+	if err != nil {
+		t.Fatalf("Unable to initialize the API: %s", err)
+	}
+	defer APIStop()
+	status := func(token string) int {
+		req := httptest.NewRequest("GET", "/get/inventory", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	err = APIReload(Options{Tokens: []Token{{Name: "new", Hash: HashToken("new-token"), Role: RoleReader}}})
+	if err != nil {
+		t.Fatalf("Unable to reload the tokens: %s", err)
+	}
+	if status("old-token") != http.StatusUnauthorized || status("new-token") != http.StatusOK {
+		t.Errorf("Tokens were not replaced by the reload")
+	}
+	if err := APIReload(Options{Tokens: []Token{{Name: "bad", Hash: "plain", Role: RoleReader}}}); err == nil {
+		t.Errorf("Invalid tokens were accepted by the reload")
+	}
+	if status("new-token") != http.StatusOK {
+		t.Errorf("Rejected reload replaced the tokens")
+	}
+	if err := APIReload(Options{}); err != nil || status("") != http.StatusOK {
+		t.Errorf("Removing the tokens didn't open the API: %v", err)
+	}
+}
+
+func TestInvalidTokenConfiguration(t *testing.T) {
+	if _, err := newAuthenticator([]Token{{Name: "ci", Hash: HashToken("token"), Role: "owner"}}); err == nil {
+		t.Errorf("Unknown role was accepted")
+	}
+	if _, err := newAuthenticator([]Token{{Name: "ci", Hash: "token", Role: RoleReader}}); err == nil {
+		t.Errorf("Token stored in plain text was accepted")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets holding the hostgroups and the hosts, keyed by their names,
+// and the details of the database itself
+var (
+	hostgroupsBucket = []byte("hostgroups")
+	hostsBucket      = []byte("hosts")
+	metaBucket       = []byte("meta")
+)
+
+// importedKey records inside the meta bucket when the JSON datastore was
+// imported. It is written along with the imported inventory, so that the
+// import is pending until it is present.
+var importedKey = []byte("imported")
+
+// boltStore keeps every hostgroup and host as its own key inside a bbolt
+// database, so that a save only writes the ones which changed.
+type boltStore struct {
+	path string
+	db   *bolt.DB
+	// importPath is the JSON datastore which is imported into the database
+	// until the import completed once
+	importPath string
+}
+
+// openBoltStore opens the bbolt database, creating it if it doesn't exist.
+// The inventory is imported from the JSON datastore at the importPath until
+// the import completed once.
+func openBoltStore(path string, importPath string) (*boltStore, error) {
+	// bbolt locks the database file, fail instead of waiting forever if
+	// another service already holds it
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{path: path, db: db}
+	if path != importPath {
+		s.importPath = importPath
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{hostgroupsBucket, hostsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads every hostgroup and host from the database. A database which
+// didn't complete the import yet is populated from the JSON datastore if
+// there is one.
+func (s *boltStore) Load() (*Inventory, error) {
+	var imported bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(metaBucket).Get(importedKey) != nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !imported {
+		inv, err := importDatastore(s.importPath, s.saveImport)
+		if err != nil || inv != nil {
+			return inv, err
+		}
+	}
+	return s.load()
+}
+
+// load reads the hostgroups and hosts stored inside the database
+func (s *boltStore) load() (*Inventory, error) {
+	inv := &Inventory{
+		Hostgroups:    make(map[string]*HostGroup),
+		Hosts:         make(map[string]*Host),
+		DataStorePath: s.path,
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(hostgroupsBucket).ForEach(func(k, v []byte) error {
+			var hostgroup *HostGroup
+			if err := decodeJSON(v, &hostgroup); err != nil {
+				return fmt.Errorf("corrupt hostgroup %s: %s", k, err)
+			}
+			inv.Hostgroups[string(k)] = hostgroup
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(hostsBucket).ForEach(func(k, v []byte) error {
+			var host *Host
+			if err := decodeJSON(v, &host); err != nil {
+				return fmt.Errorf("corrupt host %s: %s", k, err)
+			}
+			inv.Hosts[string(k)] = host
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Hostgroups) == 0 && len(inv.Hosts) == 0 {
+		return nil, nil
+	}
+	inv.linkHosts()
+	return inv, nil
+}
+
+// Save writes the changed hostgroups and hosts inside a single transaction
+// and removes the ones which were deleted.
+func (s *boltStore) Save(inv *Inventory, changes *Changeset) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.saveChanges(tx, inv, changes)
+	})
+}
+
+// saveImport writes the imported inventory and records that the import is
+// complete inside a single transaction
+func (s *boltStore) saveImport(inv *Inventory, changes *Changeset) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.saveChanges(tx, inv, changes); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(importedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+// saveChanges writes the changeset using the transaction
+func (s *boltStore) saveChanges(tx *bolt.Tx, inv *Inventory, changes *Changeset) error {
+	bucket := tx.Bucket(hostgroupsBucket)
+	for name := range changes.Hostgroups {
+		hostgroup, ok := inv.Hostgroups[name]
+		if err := putJSON(bucket, name, hostgroup, ok); err != nil {
+			return err
+		}
+	}
+	bucket = tx.Bucket(hostsBucket)
+	for name := range changes.Hosts {
+		host, ok := inv.Hosts[name]
+		if err := putJSON(bucket, name, host, ok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putJSON stores the value under the key, or deletes the key if the value
+// is no longer present.
+func putJSON(bucket *bolt.Bucket, key string, v interface{}, present bool) error {
+	if !present {
+		return bucket.Delete([]byte(key))
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+// savesChangesOnly marks the store as reading only the changed hostgroups
+// and hosts
+func (s *boltStore) savesChangesOnly() {}
+
+// Close closes the database and releases its lock
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
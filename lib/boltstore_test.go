@@ -0,0 +1,149 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTestOptions provides the options of a bbolt store kept next to a JSON
+// datastore inside the test directory
+func boltTestOptions(t *testing.T) Options {
+	dataStorePath := testDataStorePath(t)
+	return Options{
+		Backend:       BackendBolt,
+		BackendPath:   filepath.Join(filepath.Dir(dataStorePath), "inventory.bolt"),
+		DataStorePath: dataStorePath,
+		FlushInterval: 60000,
+	}
+}
+
+func TestBoltStoreRoundTrip(t *testing.T) {
+	opts := boltTestOptions(t)
+	inventory := openTestInventory(t, opts)
+	inventory.NewHost("web", "m1.example.com")
+	inventory.NewHost("web", "m2.example.com")
+	inventory.NewHost("db", "m1.example.com")
+	inventory.SetHostFact("", "m1.example.com", "cpus", 4)
+	inventory.SetHostgroupVar("web", "port", 8080)
+	inventory.NewHostgroup("prod")
+	inventory.AddChildHostgroup("prod", "web")
+	inventory.Save()
+	inventory.PurgeHost("m2.example.com")
+	inventory.DeleteHostgroup("db")
+	inventory.StopInventory()
+
+	store, err := OpenStore(opts)
+	if err != nil {
+		t.Fatalf("Unable to reopen the store: %s", err)
+	}
+	defer store.Close()
+	reloaded, err := store.Load()
+	if err != nil || reloaded == nil {
+		t.Fatalf("Unable to load the inventory: %v", err)
+	}
+	if len(reloaded.Hostgroups) != 2 || reloaded.Hostgroups["db"] != nil {
+		t.Errorf("Deleted hostgroup was not removed from the store")
+	}
+	if len(reloaded.Hosts) != 1 || reloaded.Hosts["m1.example.com"].Facts["cpus"] == nil {
+		t.Errorf("Hosts were not persisted correctly, got %v", reloaded.Hosts)
+	}
+	if reloaded.Hostgroups["web"].Hosts["m1.example.com"] != reloaded.Hosts["m1.example.com"] {
+		t.Errorf("Reloaded host is not linked with the host registry")
+	}
+	if children := reloaded.Hostgroups["prod"].Children; len(children) != 1 || children[0] != "web" {
+		t.Errorf("Children were not persisted, got %v", children)
+	}
+}
+
+func TestBoltStoreIncrementalSave(t *testing.T) {
+	store, err := OpenStore(boltTestOptions(t))
+	if err != nil {
+		t.Fatalf("Unable to open the store: %s", err)
+	}
+	defer store.Close()
+	inventory := newTestInventory()
+	inventory.dirty = newChangeset()
+	inventory.NewHost("web", "m1.example.com")
+	inventory.NewHost("db", "m2.example.com")
+	store.Save(inventory, inventory.dirty)
+
+	// Only the changed hostgroup is part of the changeset, an entry which
+	// isn't part of it is left alone even if it differs from the inventory
+	changes := newChangeset()
+	changes.Hostgroups["web"] = struct{}{}
+	delete(inventory.Hostgroups, "db")
+	inventory.SetHostgroupVar("web", "port", 8080)
+	if err := store.Save(inventory, changes); err != nil {
+		t.Fatalf("Unable to save the changes: %s", err)
+	}
+	db := store.(*boltStore).db
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(hostgroupsBucket).Get([]byte("db")) == nil {
+			t.Errorf("Unchanged hostgroup was rewritten")
+		}
+		if tx.Bucket(hostgroupsBucket).Stats().KeyN != 2 {
+			t.Errorf("Unexpected number of hostgroups stored")
+		}
+		return nil
+	})
+	reloaded, _ := store.Load()
+	if reloaded.Hostgroups["web"].Vars["port"] == nil {
+		t.Errorf("Changed hostgroup was not written")
+	}
+}
+
+func TestBoltStoreImport(t *testing.T) {
+	opts := boltTestOptions(t)
+	legacy := openTestInventory(t, Options{DataStorePath: opts.DataStorePath, FlushInterval: 60000})
+	legacy.NewHost("web", "m1.example.com")
+	legacy.SetHostFact("web", "m1.example.com", "cpus", 4)
+	legacy.StopInventory()
+
+	inventory := openTestInventory(t, opts)
+	if host := inventory.GetHost("m1.example.com"); host == nil || host.Facts["cpus"] == nil {
+		t.Fatalf("JSON datastore was not imported on the first run")
+	}
+	inventory.PurgeHost("m1.example.com")
+	inventory.Close()
+
+	// The JSON datastore is only imported until the import completed once
+	store, _ := OpenStore(opts)
+	defer store.Close()
+	reloaded, err := store.Load()
+	if err != nil || reloaded == nil || reloaded.Hostgroups["web"] == nil {
+		t.Fatalf("Unable to load the inventory: %v", err)
+	}
+	if reloaded.Hosts["m1.example.com"] != nil {
+		t.Errorf("JSON datastore was imported again")
+	}
+
+	if _, err := OpenStore(Options{Backend: BackendBolt, DataStorePath: opts.DataStorePath}); err == nil {
+		t.Errorf("Store was opened without a BackendPath")
+	}
+}
+
+func TestBoltStoreImportRetry(t *testing.T) {
+	opts := boltTestOptions(t)
+	ioutil.WriteFile(opts.DataStorePath, []byte(`{"Hostgroups": {`), 0644)
+	if _, err := Open(opts); err == nil {
+		t.Fatalf("Corrupt JSON datastore was imported")
+	}
+
+	// The failed import is retried once the datastore is repaired
+	os.Remove(opts.DataStorePath)
+	legacy := openTestInventory(t, Options{DataStorePath: opts.DataStorePath, FlushInterval: 60000})
+	legacy.NewHost("web", "m1.example.com")
+	legacy.StopInventory()
+	inventory := openTestInventory(t, opts)
+	defer inventory.Close()
+	if inventory.GetHost("m1.example.com") == nil {
+		t.Errorf("JSON datastore was not imported after the failed import")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The defaults applied to the settings missing from the configuration
+const (
+	DefaultDataStorePath  = "/var/lib/bolt/inventory.db"
+	DefaultFlushThreshold = 1000
+	DefaultMaxPendingOps  = 100000
+)
+
+// Config holds the configuration of the inventory service. The configuration
+// file can be written either in JSON or, with a .yaml or .yml extension, in
+// YAML. Both use the names of the fields as the keys.
+type Config struct {
+	// Backend selects the store which persists the inventory
+	Backend string `yaml:"Backend"`
+	// BackendPath defines the path of the database of the backend
+	BackendPath string `yaml:"BackendPath"`
+	// DataStorePath defines the path of the JSON datastore
+	DataStorePath string `yaml:"DataStorePath"`
+	// FlushInterval defines the time in milliseconds between the writes
+	FlushInterval uint16 `yaml:"FlushInterval"`
+	// FlushThreshold defines the number of pending operations after which
+	// the inventory is written without waiting for the flush interval
+	FlushThreshold uint32 `yaml:"FlushThreshold"`
+	// MaxPendingOps defines the number of operations which can wait for
+	// a failing datastore before the new ones are rejected
+	MaxPendingOps uint32 `yaml:"MaxPendingOps"`
+	// ListenAddress is the TCP address the API is served at. If neither
+	// the address nor the socket is set, the API is served at :8250.
+	ListenAddress string `yaml:"ListenAddress"`
+	// UnixSocket is the path of the Unix domain socket the API is served at
+	UnixSocket string `yaml:"UnixSocket"`
+	// TLSCert and TLSKey are the PEM files of the certificate and the key
+	// used for serving the API over TLS at the ListenAddress
+	TLSCert string `yaml:"TLSCert"`
+	TLSKey  string `yaml:"TLSKey"`
+	// ClientCA is the PEM file of the CA which the client certificates need
+	// to be signed by. Setting it requires the clients to present one.
+	ClientCA string `yaml:"ClientCA"`
+	// Tokens grants access to the API, the tokens are stored hashed
+	Tokens []Token `yaml:"Tokens"`
+	// LogLevel is one of debug, info, warning or error
+	LogLevel string `yaml:"LogLevel"`
+	// LogFormat is either logfmt or json
+	LogFormat string `yaml:"LogFormat"`
+}
+
+// DefaultConfig returns the configuration used for the settings which are
+// missing from the configuration file
+func DefaultConfig() *Config {
+	return &Config{
+		Backend:        BackendJSON,
+		DataStorePath:  DefaultDataStorePath,
+		FlushInterval:  DefaultFlushInterval,
+		FlushThreshold: DefaultFlushThreshold,
+		MaxPendingOps:  DefaultMaxPendingOps,
+		LogLevel:       "info",
+		LogFormat:      "logfmt",
+	}
+}
+
+// LoadConfig reads the configuration file on top of the defaults and then
+// applies the overrides from the BOLT_ environment variables. A missing
+// file is only an error if it is required, otherwise the defaults are used.
+// The loaded configuration still needs to be validated.
+func LoadConfig(path string, required bool) (*Config, error) {
+	config := DefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := config.decode(path, data); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %s", path, err)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read the configuration file: %s", err)
+	}
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decode reads the configuration in the format matching the extension of the
+// file. Unknown settings are rejected, since they are most likely typos.
+func (config *Config) decode(path string, data []byte) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, config)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(config)
+}
+
+// applyEnv overrides the settings with the BOLT_ environment variables
+func (config *Config) applyEnv() error {
+	strs := map[string]*string{
+		"BOLT_BACKEND":        &config.Backend,
+		"BOLT_BACKEND_PATH":   &config.BackendPath,
+		"BOLT_DATASTORE_PATH": &config.DataStorePath,
+		"BOLT_LISTEN_ADDRESS": &config.ListenAddress,
+		"BOLT_UNIX_SOCKET":    &config.UnixSocket,
+		"BOLT_TLS_CERT":       &config.TLSCert,
+		"BOLT_TLS_KEY":        &config.TLSKey,
+		"BOLT_CLIENT_CA":      &config.ClientCA,
+		"BOLT_LOG_LEVEL":      &config.LogLevel,
+		"BOLT_LOG_FORMAT":     &config.LogFormat,
+	}
+	for env, setting := range strs {
+		if value, ok := os.LookupEnv(env); ok {
+			*setting = value
+		}
+	}
+	if value, ok := os.LookupEnv("BOLT_FLUSH_INTERVAL"); ok {
+		interval, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("BOLT_FLUSH_INTERVAL needs to be a number of milliseconds up to 65535, got %q", value)
+		}
+		config.FlushInterval = uint16(interval)
+	}
+	counts := map[string]*uint32{
+		"BOLT_FLUSH_THRESHOLD": &config.FlushThreshold,
+		"BOLT_MAX_PENDING_OPS": &config.MaxPendingOps,
+	}
+	for env, setting := range counts {
+		if value, ok := os.LookupEnv(env); ok {
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("%s needs to be a number of operations, got %q", env, value)
+			}
+			*setting = uint32(count)
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports the first problem found
+func (config *Config) Validate() error {
+	switch config.Backend {
+	case "", BackendJSON, BackendBolt, BackendSQLite:
+	default:
+		return fmt.Errorf("Backend needs to be one of %s, %s or %s, got %q",
+			BackendJSON, BackendBolt, BackendSQLite, config.Backend)
+	}
+	if config.DataStorePath == "" {
+		return fmt.Errorf("DataStorePath is required")
+	}
+	if err := checkWritableDir(config.DataStorePath); err != nil {
+		return fmt.Errorf("DataStorePath %s is not usable: %s", config.DataStorePath, err)
+	}
+	if config.Backend == BackendBolt || config.Backend == BackendSQLite {
+		if config.BackendPath == "" {
+			return fmt.Errorf("BackendPath is required by the %s backend", config.Backend)
+		}
+		if filepath.Clean(config.BackendPath) == filepath.Clean(config.DataStorePath) {
+			return fmt.Errorf("BackendPath needs to differ from the DataStorePath, which holds the JSON datastore")
+		}
+	}
+	if config.BackendPath != "" {
+		if err := checkWritableDir(config.BackendPath); err != nil {
+			return fmt.Errorf("BackendPath %s is not usable: %s", config.BackendPath, err)
+		}
+	}
+	if config.FlushInterval == 0 {
+		return fmt.Errorf("FlushInterval needs to be greater than zero milliseconds")
+	}
+	if config.MaxPendingOps > 0 && config.FlushThreshold > config.MaxPendingOps {
+		return fmt.Errorf("MaxPendingOps needs to be at least the FlushThreshold of %d", config.FlushThreshold)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("TLSCert and TLSKey need to be set together")
+	}
+	if config.ClientCA != "" && config.TLSCert == "" {
+		return fmt.Errorf("ClientCA requires TLSCert and TLSKey to be set")
+	}
+	if _, err := ParseLogLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("invalid LogLevel: %s", err)
+	}
+	if _, err := ParseLogFormat(config.LogFormat); err != nil {
+		return fmt.Errorf("invalid LogFormat: %s", err)
+	}
+	if _, err := newAuthenticator(config.Tokens); err != nil {
+		return fmt.Errorf("invalid Tokens: %s", err)
+	}
+	return nil
+}
+
+// Options returns the options the inventory is created with
+func (config *Config) Options() Options {
+	return Options{
+		Backend:        config.Backend,
+		BackendPath:    config.BackendPath,
+		DataStorePath:  config.DataStorePath,
+		FlushInterval:  config.FlushInterval,
+		FlushThreshold: config.FlushThreshold,
+		MaxPendingOps:  config.MaxPendingOps,
+		Tokens:         config.Tokens,
+	}
+}
+
+// checkWritableDir checks that files can be created next to the path
+func checkWritableDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".bolt-check")
+	if err != nil {
+		return fmt.Errorf("the directory %s is not writable: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
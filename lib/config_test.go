@@ -0,0 +1,138 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes the configuration file with the name into a
+// temporary directory
+func writeTestConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write the configuration: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "inventory.json")
+	config, err := LoadConfig(missing, false)
+	if err != nil {
+		t.Fatalf("Optional configuration file should fall back to the defaults: %s", err)
+	}
+	if config.DataStorePath != DefaultDataStorePath || config.FlushInterval != DefaultFlushInterval {
+		t.Errorf("Defaults were not applied, got %+v", config)
+	}
+	if _, err := LoadConfig(missing, true); err == nil {
+		t.Errorf("Missing required configuration file was accepted")
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"inventory.json", `{"DataStorePath": "` + dir + `/data.db", "FlushThreshold": 10,
+			"Tokens": [{"Name": "ci", "Hash": "` + HashToken("token") + `", "Role": "writer"}]}`},
+		{"inventory.yaml", "DataStorePath: " + dir + "/data.db\nFlushThreshold: 10\n" +
+			"Tokens:\n  - Name: ci\n    Hash: " + HashToken("token") + "\n    Role: writer\n"},
+	}
+	for _, test := range tests {
+		config, err := LoadConfig(writeTestConfig(t, test.name, test.content), true)
+		if err != nil {
+			t.Fatalf("%s: unable to load the configuration: %s", test.name, err)
+		}
+		if config.DataStorePath != dir+"/data.db" || config.FlushThreshold != 10 {
+			t.Errorf("%s: settings were not read, got %+v", test.name, config)
+		}
+		if config.FlushInterval != DefaultFlushInterval {
+			t.Errorf("%s: missing setting didn't keep its default", test.name)
+		}
+		if len(config.Tokens) != 1 || config.Tokens[0].Role != RoleWriter {
+			t.Errorf("%s: tokens were not read, got %+v", test.name, config.Tokens)
+		}
+		if err := config.Validate(); err != nil {
+			t.Errorf("%s: valid configuration was rejected: %s", test.name, err)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"typo.json":      `{"DataStorPath": "/tmp/data.db"}`,
+		"malformed.json": `{"DataStorePath": `,
+		"typo.yaml":      "DataStorPath: /tmp/data.db\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, name, content), true); err == nil {
+			t.Errorf("%s: invalid configuration file was accepted", name)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	path := writeTestConfig(t, "inventory.json", `{"FlushInterval": 500, "Backend": "json"}`)
+	t.Setenv("BOLT_FLUSH_INTERVAL", "2000")
+	t.Setenv("BOLT_BACKEND", BackendBolt)
+	config, err := LoadConfig(path, true)
+	if err != nil {
+		t.Fatalf("Unable to load the configuration: %s", err)
+	}
+	if config.FlushInterval != 2000 || config.Backend != BackendBolt {
+		t.Errorf("Environment didn't override the configuration file, got %+v", config)
+	}
+	t.Setenv("BOLT_FLUSH_INTERVAL", "often")
+	if _, err := LoadConfig(path, true); err == nil {
+		t.Errorf("Invalid flush interval from the environment was accepted")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	readOnly := filepath.Join(dir, "readonly")
+	os.Mkdir(readOnly, 0555)
+	tests := []struct {
+		modify func(config *Config)
+		err    string
+	}{
+		{func(config *Config) { config.FlushInterval = 0 }, "FlushInterval"},
+		{func(config *Config) { config.LogLevel = "verbose" }, "LogLevel"},
+		{func(config *Config) { config.LogFormat = "xml" }, "LogFormat"},
+		{func(config *Config) { config.MaxPendingOps = 10 }, "MaxPendingOps"},
+		{func(config *Config) { config.DataStorePath = filepath.Join(dir, "missing", "data.db") }, "DataStorePath"},
+		{func(config *Config) { config.Backend = "mysql" }, "Backend"},
+		{func(config *Config) { config.Backend = BackendSQLite }, "BackendPath"},
+		{func(config *Config) { config.Backend = BackendBolt }, "BackendPath"},
+		{func(config *Config) {
+			config.Backend = BackendBolt
+			config.BackendPath = config.DataStorePath
+		}, "differ"},
+		{func(config *Config) { config.TLSCert = "cert.pem" }, "TLSKey"},
+		{func(config *Config) { config.ClientCA = "ca.pem" }, "ClientCA"},
+		{func(config *Config) { config.Tokens = []Token{{Name: "ci", Hash: "plain", Role: RoleAdmin}} }, "Tokens"},
+	}
+	// Root can write into read only directories
+	if os.Geteuid() != 0 {
+		tests = append(tests, struct {
+			modify func(config *Config)
+			err    string
+		}{func(config *Config) { config.DataStorePath = filepath.Join(readOnly, "data.db") }, "writable"})
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		config.DataStorePath = filepath.Join(dir, "data.db")
+		test.modify(config)
+		err := config.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error about %s, got %v", test.err, err)
+		}
+	}
+}
@@ -7,11 +7,13 @@
 package inventory
 
 import (
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,13 +31,14 @@ const (
 type Host struct {
 	// hostname The address through which the host can be reached
 	Hostname string
-	// fcats The host specific variable
-	Facts map[string]string
+	// fcats The host specific variable. The facts can hold any value which
+	// can be represented as JSON, including lists and nested objects.
+	Facts map[string]interface{}
 }
 
 // NewHost defines the initializer for creating a new host
 func NewHost(hostname string) *Host {
-	return &Host{Hostname: hostname, Facts: make(map[string]string)}
+	return &Host{Hostname: hostname, Facts: make(map[string]interface{})}
 }
 
 // GetHostName returns the hostname of the host
@@ -44,12 +47,12 @@ func (h Host) GetHostName() string {
 }
 
 // GetHostFacts returns the facts specific to the host
-func (h Host) GetHostFacts() map[string]string {
+func (h Host) GetHostFacts() map[string]interface{} {
 	return h.Facts
 }
 
 // SetFact sets a new host fact as defined by the name and value
-func (h *Host) SetFact(name string, value string) {
+func (h *Host) SetFact(name string, value interface{}) {
 	h.Facts[name] = value
 }
 
@@ -60,19 +63,40 @@ func (h *Host) DeleteFact(name string) {
 	}
 }
 
+// clone creates a copy of the host which can be handed out of the inventory
+// without sharing the facts mapping. The fact values themselves are never
+// modified in place and hence are shared with the copy.
+func (h *Host) clone() *Host {
+	return &Host{Hostname: h.Hostname, Facts: copyValues(h.Facts)}
+}
+
+// copyValues creates a copy of a facts or variables mapping
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		c[name] = value
+	}
+	return c
+}
+
 // HostGroup defines the structure used for storing the data for
 // the hostgroups that are registered individually in the inventory
 // service.
 type HostGroup struct {
 	// name defines the name of the hostgroup through which it can be identified
 	Name string
-	// hosts defines a slice in which the hosts belonging to a particular hostgroup can be grouped together
+	// hosts defines a slice in which the hosts belonging to a particular hostgroup can be grouped together.
+	// The hosts are shared with the inventory host registry and are persisted by their names only.
 	Hosts map[string]*Host
+	// vars defines the hostgroup local variables which apply to every host in the hostgroup
+	Vars map[string]interface{}
+	// children defines the names of the hostgroups nested under this hostgroup
+	Children []string
 }
 
 // NewHostGroup creates a new hostgroup for the inventory
 func NewHostGroup(name string) *HostGroup {
-	return &HostGroup{Name: name, Hosts: make(map[string]*Host)}
+	return &HostGroup{Name: name, Hosts: make(map[string]*Host), Vars: make(map[string]interface{})}
 }
 
 // AddHost adds a new host to the existing hostgroup
@@ -86,7 +110,7 @@ func (hg *HostGroup) AddHost(h *Host) {
 // DeleteHost removes a host from the Hostgroup
 func (hg *HostGroup) DeleteHost(hname string) {
 	if _, ok := hg.Hosts[hname]; ok {
-		hg.Hosts[hname] = nil
+		delete(hg.Hosts, hname)
 	}
 }
 
@@ -109,6 +133,152 @@ func (hg HostGroup) GetHostgroupName() string {
 	return hg.Name
 }
 
+// SetVar sets a new hostgroup variable as defined by the name and value
+func (hg *HostGroup) SetVar(name string, value interface{}) {
+	// hostgroups reloaded from an older datastore don't carry any vars
+	if hg.Vars == nil {
+		hg.Vars = make(map[string]interface{})
+	}
+	hg.Vars[name] = value
+}
+
+// DeleteVar deletes a hostgroup variable from the mapping
+func (hg *HostGroup) DeleteVar(name string) {
+	if _, ok := hg.Vars[name]; ok {
+		delete(hg.Vars, name)
+	}
+}
+
+// GetVars returns the variables specific to the hostgroup
+func (hg HostGroup) GetVars() map[string]interface{} {
+	if hg.Vars == nil {
+		return make(map[string]interface{})
+	}
+	return hg.Vars
+}
+
+// AddChild nests the named hostgroup under the hostgroup. The children
+// are kept sorted so that the inventory output remains stable.
+func (hg *HostGroup) AddChild(name string) {
+	i := sort.SearchStrings(hg.Children, name)
+	if i < len(hg.Children) && hg.Children[i] == name {
+		return
+	}
+	hg.Children = append(hg.Children, "")
+	copy(hg.Children[i+1:], hg.Children[i:])
+	hg.Children[i] = name
+}
+
+// RemoveChild removes the named hostgroup from the children of the hostgroup
+func (hg *HostGroup) RemoveChild(name string) {
+	for i, child := range hg.Children {
+		if child == name {
+			hg.Children = append(hg.Children[:i], hg.Children[i+1:]...)
+			return
+		}
+	}
+}
+
+// HasChild checks if the named hostgroup is a direct child of the hostgroup
+func (hg HostGroup) HasChild(name string) bool {
+	for _, child := range hg.Children {
+		if child == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetChildren returns the names of the hostgroups nested under the hostgroup
+func (hg HostGroup) GetChildren() []string {
+	if hg.Children == nil {
+		return make([]string, 0)
+	}
+	return hg.Children
+}
+
+// clone creates a copy of the hostgroup along with copies of its hosts
+func (hg *HostGroup) clone() *HostGroup {
+	c := &HostGroup{Name: hg.Name, Hosts: make(map[string]*Host, len(hg.Hosts)), Vars: copyValues(hg.Vars)}
+	for hname, host := range hg.Hosts {
+		c.Hosts[hname] = host.clone()
+	}
+	c.Children = append(make([]string, 0, len(hg.Children)), hg.Children...)
+	return c
+}
+
+// hostGroupJSON defines the representation in which a hostgroup is persisted.
+// Since a host can belong to multiple hostgroups, the hostgroup only stores
+// the names of its hosts while the hosts themselves are stored once inside
+// the inventory host registry.
+type hostGroupJSON struct {
+	Name     string
+	Hosts    json.RawMessage
+	Vars     map[string]interface{}
+	Children []string
+}
+
+// MarshalJSON encodes the hostgroup with its hosts referred to by their names
+func (hg HostGroup) MarshalJSON() ([]byte, error) {
+	hostnames := make([]string, 0, len(hg.Hosts))
+	for hostname := range hg.Hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	hosts, err := json.Marshal(hostnames)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(hostGroupJSON{Name: hg.Name, Hosts: hosts, Vars: hg.Vars, Children: hg.Children})
+}
+
+// UnmarshalJSON decodes the hostgroup. Besides the list of hostnames, it also
+// accepts the older representation in which every hostgroup carried its own
+// copy of the hosts. The hosts are linked with the inventory host registry
+// once the complete inventory has been decoded.
+func (hg *HostGroup) UnmarshalJSON(data []byte) error {
+	var raw hostGroupJSON
+	if err := decodeJSON(data, &raw); err != nil {
+		return err
+	}
+	hg.Name = raw.Name
+	hg.Vars = raw.Vars
+	hg.Children = raw.Children
+	hg.Hosts = make(map[string]*Host)
+	if len(raw.Hosts) == 0 || string(raw.Hosts) == "null" {
+		return nil
+	}
+	if raw.Hosts[0] == '[' {
+		var hostnames []string
+		if err := json.Unmarshal(raw.Hosts, &hostnames); err != nil {
+			return err
+		}
+		for _, hostname := range hostnames {
+			hg.Hosts[hostname] = NewHost(hostname)
+		}
+		return nil
+	}
+	var hosts map[string]*Host
+	if err := decodeJSON(raw.Hosts, &hosts); err != nil {
+		return err
+	}
+	for hostname, host := range hosts {
+		// older datastores marked the deleted hosts with a nil entry
+		if host != nil {
+			hg.Hosts[hostname] = host
+		}
+	}
+	return nil
+}
+
+// decodeJSON decodes the data while keeping the numbers as json.Number, so
+// that the numeric facts don't lose their precision while being reloaded.
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
 // Inventory struct defines the global service based inventory database
 // used to store the information of all the hostgroups and hosts.
 // The Inventory struct is used to retrieve all the data that needs to be
@@ -120,6 +290,9 @@ type Inventory struct {
 	// hostgroups store the created hostgroups along with the data related
 	// to the individual hosts inside them.
 	Hostgroups map[string]*HostGroup
+	// hosts defines the registry of all the hosts known to the inventory.
+	// A host is stored only once, no matter how many hostgroups it belongs to.
+	Hosts map[string]*Host
 	// dataStorePath defines the path where the inventory database is created
 	// on the disk. Whenever the service starts, it will look for the inventory
 	// database at the specified path and try to load the data from it.
@@ -127,118 +300,418 @@ type Inventory struct {
 	// flushInterval defines the time in milliseconds at which the inventory
 	// flush service will write the data to the disk file.
 	FlushInterval uint16
+	// flushThreshold defines the number of pending operations after which
+	// the inventory is written to the disk right away instead of waiting for
+	// the next flush interval. A threshold of 0 disables the early flush.
+	FlushThreshold uint32
 	// pendingOps provide the information about how many operations are still
 	// pending to be written to the disk. This provides some data into how much
-	// data is inventory service storing in its volatile state. This parameter
-	// can also be used in future to enhance the inventory data flush service
-	// to be more consistent and aggressive in writing the inventory to disk.
-	PendingOps uint32
+	// data is inventory service storing in its volatile state. The flush
+	// service skips the write to the disk when there is nothing pending.
+	// The counter is updated atomically and isn't part of the datastore.
+	PendingOps uint32 `json:"-"`
 
-	// A Reader Writer mutex lock to help during the Marshalling of data
+	// A Reader Writer mutex lock guarding the hostgroups and the hosts,
+	// including their facts and variables. Every exported method of the
+	// inventory takes the lock itself, and the hostgroups and hosts which
+	// are handed out to the callers are copies of the stored ones.
 	sync.RWMutex
+	// datastoreLock serializes the writes to the datastore, so that the
+	// inventory itself stays available while the data is being synced
+	datastoreLock sync.Mutex
+
+	// store persists the inventory
+	store Store
+	// dirty names the hostgroups and hosts changed since the last save
+	dirty *Changeset
+
+	// flushStats records the outcome of the last write to the datastore
+	flushStats     FlushStats
+	flushStatsLock sync.Mutex
+	// flushNow wakes up the flush service once the flush threshold is crossed
+	flushNow chan struct{}
+	// flushIntervalChanged wakes up the flush service to pick up a new
+	// flush interval
+	flushIntervalChanged chan struct{}
+
+	// opLog records the operations which are not yet part of the datastore
+	opLog *opLog
 
 	// inventoryInactive defines a channel which is used to signal the
 	// goroutines that we are closing, and they need to exit
 	inventoryInactive chan bool
+	// closeOnce guards Close, which records its outcome inside closeErr
+	closeOnce sync.Once
+	closeErr  error
+
+	// maxPendingOps limits the operations which are not yet written to the
+	// datastore, a limit of 0 disables it. The limit is only reached once
+	// the writes to the datastore fail.
+	maxPendingOps uint32
+
+	// storePath is the path of the database of the backend, whose size is
+	// exported through the metrics
+	storePath string
+	// flushMetrics records the writes made by the flush service
+	flushMetrics *flushMetrics
 }
 
-// NewInventory creates a new Inventory store to be used by the Inventory
-// Service.
-func NewInventory(dataStorePath string, flushInterval uint16) *Inventory {
-	if !checkDatastorePath(dataStorePath) {
-		ok, err := createDatastore(dataStorePath)
-		if ok != true {
-			log.Fatalf("Unable to create a datastore %s", err)
-		}
-	} else {
-		var inv *Inventory
-		f, err := os.Open(dataStorePath)
-		defer f.Close()
-		if err != nil {
-			log.Fatalf("Unable to read from the database %s", err)
-		}
-		log.Printf("Found an existing database, reloading")
-		json.NewDecoder(f).Decode(&inv)
-		return inv
-	}
+// FlushStats describes the last write of the inventory to the datastore
+type FlushStats struct {
+	// LastFlush is the time at which the last successful write finished
+	LastFlush time.Time `json:"last_flush"`
+	// LastFlushDuration is the time taken by the last successful write
+	LastFlushDuration time.Duration `json:"last_flush_duration"`
+	// Failures counts the writes which failed since the last successful
+	// one. The inventory is degraded while the writes fail.
+	Failures uint32 `json:"failures"`
+	// LastError is the error of the last failed write, if the writes fail
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Degraded reports that the inventory can't be written to the datastore.
+// The changes are still recorded inside the operation log meanwhile.
+func (stats FlushStats) Degraded() bool {
+	return stats.Failures > 0
+}
+
+// The delays between the retries of a failed write to the datastore, which
+// double with every failure
+const (
+	flushRetryMinBackoff = 100 * time.Millisecond
+	flushRetryMaxBackoff = 30 * time.Second
+)
+
+// DefaultFlushInterval is the flush interval in milliseconds which is used
+// when the inventory is created without one.
+const DefaultFlushInterval = 1000
+
+// Options defines the settings with which the inventory is created
+type Options struct {
+	// Backend selects the store which persists the inventory
+	Backend string
+	// BackendPath defines the path of the database of the bolt and sqlite
+	// backends, which require it. The JSON datastore doesn't use it.
+	BackendPath string
+	// DataStorePath defines the path of the JSON datastore
+	DataStorePath string
+	// FlushInterval defines the time in milliseconds between the writes
+	FlushInterval uint16
+	// FlushThreshold defines the number of pending operations after which
+	// the inventory is written without waiting for the flush interval
+	FlushThreshold uint32
+	// MaxPendingOps defines the number of pending operations after which
+	// the new operations are rejected with ErrTooManyPendingOps, since the
+	// datastore can't be written. A limit of 0 disables it.
+	MaxPendingOps uint32
+	// Tokens grants access to the API. Without tokens, the API is open.
+	Tokens []Token
+}
 
-	inv := Inventory{
-		Hostgroups:        make(map[string]*HostGroup),
-		DataStorePath:     dataStorePath,
-		FlushInterval:     flushInterval,
-		PendingOps:        0,
-		inventoryInactive: make(chan bool),
+// storePath returns the path of the database of the selected backend
+func (opts Options) storePath() string {
+	if opts.Backend == BackendBolt || opts.Backend == BackendSQLite {
+		return opts.BackendPath
 	}
+	return opts.DataStorePath
+}
 
+// Open opens the store selected by the options and loads the inventory kept
+// inside it, or starts an empty inventory if the store doesn't hold one yet.
+// Either way, the operations recorded inside the operation log are replayed
+// and the flush service is started. The settings of the options take
+// precedence over the ones persisted along with the inventory. The inventory
+// needs to be closed through Close.
+func Open(opts Options) (*Inventory, error) {
+	store, err := OpenStore(opts)
+	if err != nil {
+		return nil, &StorageError{Op: "open the datastore", Err: err}
+	}
+	inv, err := store.Load()
+	if err != nil {
+		store.Close()
+		return nil, &StorageError{Op: "read from the datastore", Err: err}
+	}
+	if inv != nil {
+		Logf(LevelInfo, "Found an existing database, reloading")
+	} else {
+		inv = &Inventory{}
+	}
+	if inv.Hostgroups == nil {
+		inv.Hostgroups = make(map[string]*HostGroup)
+	}
+	if inv.Hosts == nil {
+		inv.Hosts = make(map[string]*Host)
+	}
+	inv.DataStorePath = opts.DataStorePath
+	inv.FlushInterval = opts.FlushInterval
+	inv.FlushThreshold = opts.FlushThreshold
+	inv.maxPendingOps = opts.MaxPendingOps
+	inv.store = store
+	inv.storePath = opts.storePath()
+	inv.flushMetrics = newFlushMetrics()
+	inv.dirty = newChangeset()
+	inv.flushNow = make(chan struct{}, 1)
+	inv.flushIntervalChanged = make(chan struct{}, 1)
+	inv.inventoryInactive = make(chan bool)
+	if err := inv.attachOpLog(opts.storePath()); err != nil {
+		store.Close()
+		return nil, err
+	}
 	go inv.flushInventoryService()
-	return &inv
+	return inv, nil
 }
 
-// GetInventory retrieves the inventory from the inventory database
+// GetInventory retrieves a copy of the inventory from the inventory database
 func (inv *Inventory) GetInventory() map[string]*HostGroup {
-	return inv.Hostgroups
-}
-// toJSON converts the current state of the inventory structure to JSON
-// representational form which can be written to disk or transmitted back
-// to the caller. In case of error, the function returns a nil value.
-func (inv *Inventory) toJSON() []byte {
 	inv.RLock()
 	defer inv.RUnlock()
-	invJSON, err := json.Marshal(inv)
-	if err != nil {
-		log.Fatalf("Unable to encode the data as valid JSON", err)
-		return nil
+	hostgroups := make(map[string]*HostGroup, len(inv.Hostgroups))
+	for hgname, hostgroup := range inv.Hostgroups {
+		hostgroups[hgname] = hostgroup.clone()
 	}
-	return invJSON
+	return hostgroups
+}
+
+// linkHosts points the hostgroups of a freshly decoded inventory to the hosts
+// inside the host registry. Hosts which are missing from the registry, as is
+// the case with datastores written before the registry existed, are added to
+// it. When the older datastores carry conflicting copies of the same host,
+// the facts of the copies are merged together.
+func (inv *Inventory) linkHosts() {
+	if inv.Hostgroups == nil {
+		inv.Hostgroups = make(map[string]*HostGroup)
+	}
+	if inv.Hosts == nil {
+		inv.Hosts = make(map[string]*Host)
+	}
+	for hostname, host := range inv.Hosts {
+		if host.Facts == nil {
+			host.Facts = make(map[string]interface{})
+		}
+		host.Hostname = hostname
+	}
+	for _, hostgroup := range inv.Hostgroups {
+		for hostname, host := range hostgroup.Hosts {
+			registered, ok := inv.Hosts[hostname]
+			if !ok {
+				registered = NewHost(hostname)
+				inv.Hosts[hostname] = registered
+			}
+			if host != registered {
+				for fname, fval := range host.Facts {
+					if _, ok := registered.Facts[fname]; !ok {
+						registered.SetFact(fname, fval)
+					}
+				}
+			}
+			hostgroup.Hosts[hostname] = registered
+		}
+	}
+}
+// toJSON converts the current state of the inventory structure to JSON
+// representational form which can be written to disk or transmitted back
+// to the caller. The caller needs to hold the read lock.
+func (inv *Inventory) toJSON() ([]byte, error) {
+	return json.Marshal(inv)
 }
 
 // Save defines a public interface for the inventory structure to write its
-// data to the datastore.
-func (inv *Inventory) Save() {
-	// check if the datastore actually exists or not
-	if checkDatastorePath(inv.DataStorePath) == false {
-		// we don't have the data store present, try to create one
-		_, err := createDatastore(inv.DataStorePath)
-		if err != nil {
-			log.Fatalf("Unable to create a datastore", err)
+// data to the datastore. The data is written from a snapshot, so that the
+// inventory stays available while the datastore is being synced. If the
+// write fails, the pending operations are kept for the next attempt and the
+// failure is recorded inside the flush stats.
+func (inv *Inventory) Save() error {
+	inv.datastoreLock.Lock()
+	defer inv.datastoreLock.Unlock()
+	// The snapshot is taken under the write lock along with the position of
+	// the operation log, so that it holds exactly the operations logged
+	// before that position
+	inv.Lock()
+	changes := inv.dirty
+	if changes == nil {
+		changes = newChangeset()
+	}
+	_, changesOnly := inv.store.(changesOnlyStore)
+	snapshot := inv.snapshot(changes, changesOnly)
+	inv.dirty = newChangeset()
+	pending := atomic.LoadUint32(&inv.PendingOps)
+	var logged int64
+	if inv.opLog != nil {
+		logged = inv.opLog.size
+	}
+	inv.Unlock()
+
+	start := time.Now()
+	if err := inv.store.Save(snapshot, changes); err != nil {
+		inv.Lock()
+		inv.dirty.merge(changes)
+		inv.Unlock()
+		inv.flushStatsLock.Lock()
+		inv.flushStats.Failures++
+		inv.flushStats.LastError = err.Error()
+		inv.flushStatsLock.Unlock()
+		return &StorageError{Op: "write the datastore", Err: err}
+	}
+	// The operations logged while the datastore was being written are kept
+	// for the next save
+	inv.Lock()
+	if inv.opLog != nil {
+		if err := inv.opLog.discard(logged); err != nil {
+			Logf(LevelError, "Unable to discard the saved operations from the operation log: %s", err)
+		}
+	}
+	if pending > 0 {
+		atomic.AddUint32(&inv.PendingOps, ^(pending - 1))
+	}
+	inv.Unlock()
+	inv.flushStatsLock.Lock()
+	if inv.flushStats.Failures > 0 {
+		Logf(LevelInfo, "Writing to the datastore recovered after %d failures", inv.flushStats.Failures)
+	}
+	inv.flushStats = FlushStats{
+		LastFlush:         time.Now(),
+		LastFlushDuration: time.Since(start),
+	}
+	inv.flushStatsLock.Unlock()
+	return nil
+}
+
+// snapshot copies the inventory to be written to the datastore. If
+// changesOnly is set, only the changed hostgroups and hosts are copied. The
+// hosts of the copied hostgroups which aren't part of the snapshot are only
+// referred to by their names, which is all the stores read from a
+// hostgroup. The caller needs to hold the read lock.
+func (inv *Inventory) snapshot(changes *Changeset, changesOnly bool) *Inventory {
+	s := &Inventory{
+		Hostgroups:     make(map[string]*HostGroup),
+		Hosts:          make(map[string]*Host),
+		DataStorePath:  inv.DataStorePath,
+		FlushInterval:  inv.FlushInterval,
+		FlushThreshold: inv.FlushThreshold,
+	}
+	if changesOnly {
+		for hostname := range changes.Hosts {
+			if host, ok := inv.Hosts[hostname]; ok {
+				s.Hosts[hostname] = host.clone()
+			}
+		}
+	} else {
+		for hostname, host := range inv.Hosts {
+			s.Hosts[hostname] = host.clone()
 		}
 	}
-	jsonData := inv.toJSON()
-	if jsonData == nil {
-		log.Fatalf("Unable to convert the data into valid JSON")
+	copyHostgroup := func(hg *HostGroup) {
+		c := &HostGroup{Name: hg.Name, Hosts: make(map[string]*Host, len(hg.Hosts)), Vars: copyValues(hg.Vars)}
+		for hostname := range hg.Hosts {
+			host, ok := s.Hosts[hostname]
+			if !ok {
+				host = &Host{Hostname: hostname}
+			}
+			c.Hosts[hostname] = host
+		}
+		c.Children = append(make([]string, 0, len(hg.Children)), hg.Children...)
+		s.Hostgroups[hg.Name] = c
 	}
-	if inv.WriteData(jsonData) == false {
-		log.Fatalf("Scheduled inventory save failed. Exiting...")
+	if changesOnly {
+		for hgname := range changes.Hostgroups {
+			if hg, ok := inv.Hostgroups[hgname]; ok {
+				copyHostgroup(hg)
+			}
+		}
+	} else {
+		for _, hg := range inv.Hostgroups {
+			copyHostgroup(hg)
+		}
 	}
+	return s
 }
 
-// WriteData writes the binary data to the datastore and
-// returns a boolean to indicate if the write was successful
-// or not.
-func (inv *Inventory) WriteData(data []byte) bool {
-	inv.Lock()
-	defer inv.Unlock()
-	err := ioutil.WriteFile(inv.DataStorePath, data, 0644)
-	if err != nil {
-		log.Printf("File data write failed", err)
-		return false
+// counts returns the number of hostgroups, hosts and facts of the inventory
+func (inv *Inventory) counts() (hostgroups int, hosts int, facts int) {
+	inv.RLock()
+	defer inv.RUnlock()
+	for _, host := range inv.Hosts {
+		facts += len(host.Facts)
 	}
-	return true
+	return len(inv.Hostgroups), len(inv.Hosts), facts
+}
+
+// GetFlushStats returns the details of the last write to the datastore
+func (inv *Inventory) GetFlushStats() FlushStats {
+	inv.flushStatsLock.Lock()
+	defer inv.flushStatsLock.Unlock()
+	return inv.flushStats
+}
+
+// WriteData atomically writes the binary data to the datastore
+func (inv *Inventory) WriteData(data []byte) error {
+	inv.datastoreLock.Lock()
+	defer inv.datastoreLock.Unlock()
+	if err := writeDatastore(inv.DataStorePath, data); err != nil {
+		return &StorageError{Op: "write the datastore", Err: err}
+	}
+	return nil
 }
 
 // NewHostgroup creates a new hostgroup and adds it to the
 // inventory. If the hostgroup already exists, the call returns
 // without making any changes.
-func (inv *Inventory) NewHostgroup(hgname string) {
-	if _, ok := inv.Hostgroups[hgname]; !ok {
-		hg := NewHostGroup(hgname)
+func (inv *Inventory) NewHostgroup(hgname string) error {
+	return inv.commit(operation{Op: opNewHostgroup, Hostgroup: hgname})
+}
+
+// newHostgroup creates the hostgroup if it doesn't exists yet and returns it.
+// ErrCapacityExceeded is returned if the inventory can't hold another
+// hostgroup.
+func (inv *Inventory) newHostgroup(hgname string) (*HostGroup, error) {
+	if err := inv.checkNewHostgroup(hgname); err != nil {
+		return nil, err
+	}
+	hg, ok := inv.Hostgroups[hgname]
+	if !ok {
+		hg = NewHostGroup(hgname)
 		inv.Hostgroups[hgname] = hg
 	}
+	return hg, nil
 }
 
-// GetHostgroup retrieves the hostgroup when the name is provided
+// checkNewHostgroup makes sure that the hostgroup either exists already or
+// fits into the InventoryCapacity, the caller needs to hold the lock
+func (inv *Inventory) checkNewHostgroup(hgname string) error {
+	if _, ok := inv.Hostgroups[hgname]; !ok && len(inv.Hostgroups) >= InventoryCapacity {
+		return ErrCapacityExceeded
+	}
+	return nil
+}
+
+// checkNewMember makes sure that the host either belongs to the hostgroup
+// already or fits into the HostgroupCapacity. A hostgroup which doesn't
+// exist yet has room for the host. The caller needs to hold the lock.
+func (inv *Inventory) checkNewMember(hgname string, hname string) error {
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return nil
+	}
+	if _, ok := hostgroup.Hosts[hname]; !ok && len(hostgroup.Hosts) >= HostgroupCapacity {
+		return ErrCapacityExceeded
+	}
+	return nil
+}
+
+// GetHostgroup retrieves a copy of the hostgroup when the name is provided
 // if the hostgroup doesn't exists, the call returns a nil
-func (inv Inventory) GetHostgroup(hgname string) *HostGroup {
+func (inv *Inventory) GetHostgroup(hgname string) *HostGroup {
+	inv.RLock()
+	defer inv.RUnlock()
+	if hg := inv.getHostgroup(hgname); hg != nil {
+		return hg.clone()
+	}
+	return nil
+}
+
+// getHostgroup retrieves the stored hostgroup, the caller needs to hold the lock
+func (inv *Inventory) getHostgroup(hgname string) *HostGroup {
 	if hg, ok := inv.Hostgroups[hgname]; ok {
 		return hg
 	}
@@ -247,71 +720,622 @@ func (inv Inventory) GetHostgroup(hgname string) *HostGroup {
 
 // NewHost creates a new host under the specified hostgroup
 // if the hostgroup doesn't exists, then it is created and then
-// a new host added to it.
-func (inv *Inventory) NewHost(hgname string, hname string) {
-	// check if the hostgroup already exists, and create if it doesn't
-	inv.NewHostgroup(hgname)
-	// retrieve the hostgroup
-	hostgroup := inv.GetHostgroup(hgname)
+// a new host added to it. If the host is already known to the
+// inventory, the existing host along with its facts is added
+// to the hostgroup.
+func (inv *Inventory) NewHost(hgname string, hname string) error {
+	return inv.commit(operation{Op: opNewHost, Hostgroup: hgname, Hostname: hname})
+}
+
+// newHost creates the host inside the hostgroup, the caller needs to hold the lock
+func (inv *Inventory) newHost(hgname string, hname string) error {
+	if err := inv.checkNewMember(hgname, hname); err != nil {
+		return err
+	}
+	// create the hostgroup if it doesn't exists yet and retrieve it
+	hostgroup, err := inv.newHostgroup(hgname)
+	if err != nil {
+		return err
+	}
+	host := inv.getHost(hname)
+	if host == nil {
+		host = NewHost(hname)
+		inv.Hosts[hname] = host
+	}
+	hostgroup.AddHost(host)
+	return nil
+}
+
+// GetHost retrieves a copy of the host from the host registry when the
+// name is provided. If the host doesn't exists, the call returns a nil
+func (inv *Inventory) GetHost(hname string) *Host {
+	inv.RLock()
+	defer inv.RUnlock()
+	if host := inv.getHost(hname); host != nil {
+		return host.clone()
+	}
+	return nil
+}
+
+// getHost retrieves the stored host, the caller needs to hold the lock
+func (inv *Inventory) getHost(hname string) *Host {
+	if host, ok := inv.Hosts[hname]; ok {
+		return host
+	}
+	return nil
+}
+
+// GetHostgroupNames returns the names of the hostgroups the host belongs to
+func (inv *Inventory) GetHostgroupNames(hname string) []string {
+	inv.RLock()
+	defer inv.RUnlock()
+	return inv.hostgroupNames(hname)
+}
+
+// hostgroupNames lists the hostgroups of the host, the caller needs to hold the lock
+func (inv *Inventory) hostgroupNames(hname string) []string {
+	hgnames := make([]string, 0)
+	for hgname, hostgroup := range inv.Hostgroups {
+		if hostgroup.GetHost(hname) != nil {
+			hgnames = append(hgnames, hgname)
+		}
+	}
+	sort.Strings(hgnames)
+	return hgnames
+}
+
+// AddHostToHostgroup adds an already existing host to another hostgroup.
+// The host keeps sharing its facts across all of its hostgroups.
+func (inv *Inventory) AddHostToHostgroup(hgname string, hname string) error {
+	return inv.commit(operation{Op: opAddHostToHostgroup, Hostgroup: hgname, Hostname: hname})
+}
+
+// addHostToHostgroup adds the host to the hostgroup, the caller needs to hold the lock
+func (inv *Inventory) addHostToHostgroup(hgname string, hname string) error {
+	hostgroup := inv.getHostgroup(hgname)
 	if hostgroup == nil {
-		log.Fatalf("Unable to retireve the hostgroup")
+		return ErrHostgroupNotFound
+	}
+	host := inv.getHost(hname)
+	if host == nil {
+		return ErrHostNotFound
+	}
+	if err := inv.checkNewMember(hgname, hname); err != nil {
+		return err
 	}
-	host := NewHost(hname)
 	hostgroup.AddHost(host)
+	return nil
+}
+
+// RemoveHostFromHostgroup removes the host from the hostgroup without
+// deleting the host from the inventory, even if the host doesn't belong
+// to any other hostgroup. If the host isn't a member of the hostgroup,
+// ErrHostNotFound is returned.
+func (inv *Inventory) RemoveHostFromHostgroup(hgname string, hname string) error {
+	return inv.commit(operation{Op: opRemoveHostFromHostgroup, Hostgroup: hgname, Hostname: hname})
+}
+
+// removeHostFromHostgroup removes the membership, the caller needs to hold the lock
+func (inv *Inventory) removeHostFromHostgroup(hgname string, hname string) error {
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return ErrHostgroupNotFound
+	}
+	if hostgroup.GetHost(hname) == nil {
+		return ErrHostNotFound
+	}
+	hostgroup.DeleteHost(hname)
+	return nil
+}
+
+// GetUngroupedHosts returns the names of the hosts which don't belong to
+// any hostgroup.
+func (inv *Inventory) GetUngroupedHosts() []string {
+	inv.RLock()
+	defer inv.RUnlock()
+	return inv.ungroupedHosts()
+}
+
+// ungroupedHosts lists the hosts without a hostgroup, the caller needs to hold the lock
+func (inv *Inventory) ungroupedHosts() []string {
+	hostnames := make([]string, 0)
+	for hostname := range inv.Hosts {
+		if len(inv.hostgroupNames(hostname)) == 0 {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
 }
 
-// GetHosts returns the list of hosts based in a hostgroup
-func (inv Inventory) GetHosts(hgname string) map[string]*Host {
-	hostgroup := inv.GetHostgroup(hgname)
+// GetHosts returns copies of the hosts based in a hostgroup
+func (inv *Inventory) GetHosts(hgname string) map[string]*Host {
+	inv.RLock()
+	defer inv.RUnlock()
+	hostgroup := inv.getHostgroup(hgname)
 	if hostgroup != nil {
-		return hostgroup.GetHosts()
+		hosts := make(map[string]*Host, len(hostgroup.Hosts))
+		for hname, host := range hostgroup.GetHosts() {
+			hosts[hname] = host.clone()
+		}
+		return hosts
 	}
 	return nil
 }
 
+// DeleteHostgroup removes the hostgroup along with all the hosts
+// inside it from the inventory. Hosts which also belong to other
+// hostgroups are kept. If the hostgroup doesn't exists,
+// ErrHostgroupNotFound is returned.
+// Hostgroups which had the deleted hostgroup as a child stop referring to it.
+func (inv *Inventory) DeleteHostgroup(hgname string) error {
+	return inv.commit(operation{Op: opDeleteHostgroup, Hostgroup: hgname})
+}
+
+// deleteHostgroup removes the hostgroup, the caller needs to hold the lock
+func (inv *Inventory) deleteHostgroup(hgname string) error {
+	hostgroup, ok := inv.Hostgroups[hgname]
+	if !ok {
+		return ErrHostgroupNotFound
+	}
+	delete(inv.Hostgroups, hgname)
+	for _, hg := range inv.Hostgroups {
+		hg.RemoveChild(hgname)
+	}
+	for hname := range hostgroup.Hosts {
+		inv.pruneHost(hname)
+	}
+	return nil
+}
+
+// DeleteHost removes the host from the specified hostgroup. Once the
+// host doesn't belong to any hostgroup, it is deleted from the inventory.
+// If either the hostgroup or the host doesn't exists, ErrHostgroupNotFound
+// or ErrHostNotFound is returned.
+func (inv *Inventory) DeleteHost(hgname string, hname string) error {
+	return inv.commit(operation{Op: opDeleteHost, Hostgroup: hgname, Hostname: hname})
+}
+
+// deleteHost removes the host from the hostgroup, the caller needs to hold the lock
+func (inv *Inventory) deleteHost(hgname string, hname string) error {
+	if err := inv.removeHostFromHostgroup(hgname, hname); err != nil {
+		return err
+	}
+	inv.pruneHost(hname)
+	return nil
+}
+
+// PurgeHost deletes the host from all of its hostgroups along with the
+// inventory. If the host doesn't exists, ErrHostNotFound is returned.
+func (inv *Inventory) PurgeHost(hname string) error {
+	return inv.commit(operation{Op: opPurgeHost, Hostname: hname})
+}
+
+// purgeHost deletes the host everywhere, the caller needs to hold the lock
+func (inv *Inventory) purgeHost(hname string) error {
+	if _, ok := inv.Hosts[hname]; !ok {
+		return ErrHostNotFound
+	}
+	for _, hostgroup := range inv.Hostgroups {
+		hostgroup.DeleteHost(hname)
+	}
+	delete(inv.Hosts, hname)
+	return nil
+}
+
+// pruneHost deletes the host from the inventory if it doesn't belong
+// to any hostgroup anymore.
+func (inv *Inventory) pruneHost(hname string) {
+	if len(inv.hostgroupNames(hname)) == 0 {
+		delete(inv.Hosts, hname)
+	}
+}
+
 // SetHostFact sets a new fact for the host. If the fact already exists,
-// it's value is overwritten
-func (inv *Inventory) SetHostFact(hgname string, hname string, fname string, fval string) bool {
-	hostgroup := inv.GetHostgroup(hgname)
-	if hostgroup != nil {
-		host := hostgroup.GetHost(hname)
-		if host != nil {
-			host.SetFact(fname, fval)
-			return true
+// it's value is overwritten. Since the facts are shared by all the
+// hostgroups of the host, the hostgroup is only used to validate the
+// membership of the host and can be left empty.
+func (inv *Inventory) SetHostFact(hgname string, hname string, fname string, fval interface{}) error {
+	return inv.commit(operation{Op: opSetHostFact, Hostgroup: hgname, Hostname: hname, Name: fname, Value: fval})
+}
+
+// setHostFact sets the fact on the host, the caller needs to hold the lock
+func (inv *Inventory) setHostFact(hgname string, hname string, fname string, fval interface{}) error {
+	host, err := inv.lookupHost(hgname, hname)
+	if err != nil {
+		return err
+	}
+	host.SetFact(fname, fval)
+	return nil
+}
+
+// SetHostFacts sets all the facts on the host at once, either all of them
+// are set or none is. Like with SetHostFact, the hostgroup is only used to
+// validate the membership of the host and can be left empty.
+func (inv *Inventory) SetHostFacts(hgname string, hname string, facts map[string]interface{}) error {
+	return inv.commit(operation{Op: opSetHostFacts, Hostgroup: hgname, Hostname: hname, Values: facts})
+}
+
+// setHostFacts sets the facts on the host, the caller needs to hold the lock
+func (inv *Inventory) setHostFacts(hgname string, hname string, facts map[string]interface{}) error {
+	host, err := inv.lookupHost(hgname, hname)
+	if err != nil {
+		return err
+	}
+	for fname, fval := range facts {
+		host.SetFact(fname, fval)
+	}
+	return nil
+}
+
+// lookupHost retrieves the host from the registry. If a hostgroup is
+// provided, the host is only returned if it belongs to the hostgroup.
+func (inv *Inventory) lookupHost(hgname string, hname string) (*Host, error) {
+	var host *Host
+	if hgname == "" {
+		host = inv.getHost(hname)
+	} else {
+		hostgroup := inv.getHostgroup(hgname)
+		if hostgroup == nil {
+			return nil, ErrHostgroupNotFound
+		}
+		host = hostgroup.GetHost(hname)
+	}
+	if host == nil {
+		return nil, ErrHostNotFound
+	}
+	return host, nil
+}
+
+// DeleteHostFact removes a fact from the host. If the hostgroup, host
+// or the fact doesn't exists, ErrHostgroupNotFound, ErrHostNotFound or
+// ErrFactNotFound is returned.
+func (inv *Inventory) DeleteHostFact(hgname string, hname string, fname string) error {
+	return inv.commit(operation{Op: opDeleteHostFact, Hostgroup: hgname, Hostname: hname, Name: fname})
+}
+
+// deleteHostFact removes the fact from the host, the caller needs to hold the lock
+func (inv *Inventory) deleteHostFact(hgname string, hname string, fname string) error {
+	host, err := inv.lookupHost(hgname, hname)
+	if err != nil {
+		return err
+	}
+	if _, ok := host.Facts[fname]; !ok {
+		return ErrFactNotFound
+	}
+	host.DeleteFact(fname)
+	return nil
+}
+
+// SetHostgroupVar sets a new variable for the hostgroup. If the variable
+// already exists, it's value is overwritten
+func (inv *Inventory) SetHostgroupVar(hgname string, vname string, vval interface{}) error {
+	return inv.commit(operation{Op: opSetHostgroupVar, Hostgroup: hgname, Name: vname, Value: vval})
+}
+
+// setHostgroupVar sets the hostgroup variable, the caller needs to hold the lock
+func (inv *Inventory) setHostgroupVar(hgname string, vname string, vval interface{}) error {
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return ErrHostgroupNotFound
+	}
+	hostgroup.SetVar(vname, vval)
+	return nil
+}
+
+// SetHostgroupVars sets all the variables on the hostgroup at once, either
+// all of them are set or none is.
+func (inv *Inventory) SetHostgroupVars(hgname string, vars map[string]interface{}) error {
+	return inv.commit(operation{Op: opSetHostgroupVars, Hostgroup: hgname, Values: vars})
+}
+
+// setHostgroupVars sets the hostgroup variables, the caller needs to hold the lock
+func (inv *Inventory) setHostgroupVars(hgname string, vars map[string]interface{}) error {
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return ErrHostgroupNotFound
+	}
+	for vname, vval := range vars {
+		hostgroup.SetVar(vname, vval)
+	}
+	return nil
+}
+
+// DeleteHostgroupVar removes a variable from the hostgroup. If the
+// hostgroup or the variable doesn't exists, ErrHostgroupNotFound or
+// ErrVarNotFound is returned.
+func (inv *Inventory) DeleteHostgroupVar(hgname string, vname string) error {
+	return inv.commit(operation{Op: opDeleteHostgroupVar, Hostgroup: hgname, Name: vname})
+}
+
+// deleteHostgroupVar removes the hostgroup variable, the caller needs to hold the lock
+func (inv *Inventory) deleteHostgroupVar(hgname string, vname string) error {
+	hostgroup := inv.getHostgroup(hgname)
+	if hostgroup == nil {
+		return ErrHostgroupNotFound
+	}
+	if _, ok := hostgroup.Vars[vname]; !ok {
+		return ErrVarNotFound
+	}
+	hostgroup.DeleteVar(vname)
+	return nil
+}
+
+// AddChildHostgroup nests the child hostgroup under the parent hostgroup.
+// Both the hostgroups need to exist already. ErrHostgroupCycle is returned
+// if the parent is the child itself or is already nested under the child.
+func (inv *Inventory) AddChildHostgroup(parent string, child string) error {
+	return inv.commit(operation{Op: opAddChildHostgroup, Hostgroup: parent, Name: child})
+}
+
+// addChildHostgroup nests the hostgroup, the caller needs to hold the lock
+func (inv *Inventory) addChildHostgroup(parent string, child string) error {
+	hostgroup := inv.getHostgroup(parent)
+	if hostgroup == nil || inv.getHostgroup(child) == nil {
+		return ErrHostgroupNotFound
+	}
+	if parent == child || inv.isDescendant(child, parent) {
+		return ErrHostgroupCycle
+	}
+	hostgroup.AddChild(child)
+	return nil
+}
+
+// RemoveChildHostgroup removes the child hostgroup from the parent hostgroup.
+// The child hostgroup itself is left intact. If the parent doesn't have such
+// a child, ErrHostgroupNotFound is returned.
+func (inv *Inventory) RemoveChildHostgroup(parent string, child string) error {
+	return inv.commit(operation{Op: opRemoveChildHostgroup, Hostgroup: parent, Name: child})
+}
+
+// removeChildHostgroup removes the nesting, the caller needs to hold the lock
+func (inv *Inventory) removeChildHostgroup(parent string, child string) error {
+	hostgroup := inv.getHostgroup(parent)
+	if hostgroup == nil || !hostgroup.HasChild(child) {
+		return ErrHostgroupNotFound
+	}
+	hostgroup.RemoveChild(child)
+	return nil
+}
+
+// GetHostgroupVars returns the variables which apply to the hosts of the
+// hostgroup, including the ones inherited from its parent hostgroups.
+// Following the Ansible precedence, the variables of the shallower
+// hostgroups are applied first and are overridden by the deeper ones,
+// while hostgroups at the same depth are applied in the order of their
+// names. If the hostgroup doesn't exists, the call returns nil.
+func (inv *Inventory) GetHostgroupVars(hgname string) map[string]interface{} {
+	inv.RLock()
+	defer inv.RUnlock()
+	return inv.hostgroupVars(hgname)
+}
+
+// hostgroupVars resolves the inherited variables, the caller needs to hold the lock
+func (inv *Inventory) hostgroupVars(hgname string) map[string]interface{} {
+	if inv.getHostgroup(hgname) == nil {
+		return nil
+	}
+	return inv.lineageVars([]string{hgname})
+}
+
+// lineageVars merges the variables of the hostgroups along with the ones of
+// all their ancestors in the order of the Ansible precedence. The caller
+// needs to hold the lock.
+func (inv *Inventory) lineageVars(hgnames []string) map[string]interface{} {
+	parents := inv.parentIndex()
+	// collect the hostgroups along with all of their ancestors
+	lineage := append([]string{}, hgnames...)
+	seen := make(map[string]bool, len(hgnames))
+	for _, name := range hgnames {
+		seen[name] = true
+	}
+	for i := 0; i < len(lineage); i++ {
+		for _, parent := range parents[lineage[i]] {
+			if !seen[parent] {
+				seen[parent] = true
+				lineage = append(lineage, parent)
+			}
+		}
+	}
+	depths := make(map[string]int, len(lineage))
+	for _, name := range lineage {
+		depths[name] = hostgroupDepth(name, parents, depths)
+	}
+	sort.Slice(lineage, func(i, j int) bool {
+		if depths[lineage[i]] != depths[lineage[j]] {
+			return depths[lineage[i]] < depths[lineage[j]]
+		}
+		return lineage[i] < lineage[j]
+	})
+	vars := make(map[string]interface{})
+	for _, name := range lineage {
+		for vname, vval := range inv.Hostgroups[name].GetVars() {
+			vars[vname] = vval
+		}
+	}
+	return vars
+}
+
+// isDescendant checks if the target hostgroup is nested, directly or
+// indirectly, under the root hostgroup.
+func (inv *Inventory) isDescendant(root string, target string) bool {
+	stack := []string{root}
+	seen := make(map[string]bool)
+	for len(stack) > 0 {
+		name := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		hostgroup := inv.getHostgroup(name)
+		if hostgroup == nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, child := range hostgroup.Children {
+			if child == target {
+				return true
+			}
+			stack = append(stack, child)
 		}
-		return false
 	}
 	return false
 }
 
+// parentIndex maps every hostgroup name to the hostgroups it is a child of
+func (inv *Inventory) parentIndex() map[string][]string {
+	parents := make(map[string][]string)
+	for hgname, hostgroup := range inv.Hostgroups {
+		for _, child := range hostgroup.Children {
+			parents[child] = append(parents[child], hgname)
+		}
+	}
+	return parents
+}
+
+// hostgroupDepth computes the length of the longest chain of parents above
+// the hostgroup. Top level hostgroups have a depth of zero.
+func hostgroupDepth(hgname string, parents map[string][]string, depths map[string]int) int {
+	if depth, ok := depths[hgname]; ok {
+		return depth
+	}
+	depth := 0
+	for _, parent := range parents[hgname] {
+		if d := hostgroupDepth(parent, parents, depths) + 1; d > depth {
+			depth = d
+		}
+	}
+	depths[hgname] = depth
+	return depth
+}
+
+// flushInventoryService writes the inventory to the datastore at every
+// flush interval and whenever the flush threshold is crossed. A failed write
+// is retried with an exponential backoff, without waiting for the interval,
+// and the other writes are held off until the retry.
 func (inv *Inventory) flushInventoryService() {
-	log.Printf("Starting the flushInventory service")
+	Logf(LevelDebug, "Starting the flushInventory service")
+	ticker := time.NewTicker(inv.flushInterval())
+	defer ticker.Stop()
+	// retry is armed while the writes to the datastore fail
+	var retry <-chan time.Time
+	var backoff time.Duration
 	for {
 		select {
 		case sig := <-inv.inventoryInactive:
-			log.Printf("Shutdown signal received. Storing the structures and shutting down")
+			Logf(LevelDebug, "Shutdown signal received, stopping the flushInventory service")
 			if sig == true {
-				inv.Save()
 				inv.inventoryInactive <- true
 				return
 			}
+			continue
+		case <-inv.flushIntervalChanged:
+			ticker.Reset(inv.flushInterval())
+			continue
+		case <-ticker.C:
+		case <-inv.flushNow:
+		case <-retry:
+			retry = nil
+		}
+		if retry != nil {
+			continue
+		}
+		start := time.Now()
+		flushed, err := inv.flush()
+		if flushed || err != nil {
+			inv.flushMetrics.observe(time.Since(start), err)
+		}
+		if err != nil {
+			backoff = nextFlushBackoff(backoff)
+			Logf(LevelError, "%s, retrying in %s", err, backoff)
+			retry = time.After(backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// nextFlushBackoff returns the delay before the next retry of a failed write
+func nextFlushBackoff(backoff time.Duration) time.Duration {
+	if backoff < flushRetryMinBackoff {
+		return flushRetryMinBackoff
+	}
+	if backoff*2 > flushRetryMaxBackoff {
+		return flushRetryMaxBackoff
+	}
+	return backoff * 2
+}
+
+// flushInterval returns the time between the writes to the datastore
+func (inv *Inventory) flushInterval() time.Duration {
+	inv.RLock()
+	defer inv.RUnlock()
+	if inv.FlushInterval == 0 {
+		return DefaultFlushInterval * time.Millisecond
+	}
+	return time.Duration(inv.FlushInterval) * time.Millisecond
+}
+
+// SetMaxPendingOps changes the number of pending operations after which the
+// new operations are rejected, a limit of 0 disables it
+func (inv *Inventory) SetMaxPendingOps(max uint32) {
+	inv.Lock()
+	inv.maxPendingOps = max
+	inv.Unlock()
+}
+
+// SetFlushSettings changes the flush interval and threshold of the running
+// inventory. The new interval applies from the next write on.
+func (inv *Inventory) SetFlushSettings(interval uint16, threshold uint32) {
+	inv.Lock()
+	changed := inv.FlushInterval != interval
+	inv.FlushInterval = interval
+	inv.FlushThreshold = threshold
+	inv.Unlock()
+	if changed {
+		select {
+		case inv.flushIntervalChanged <- struct{}{}:
 		default:
-			inv.Save()
-			time.Sleep(time.Duration(inv.FlushInterval))
 		}
 	}
 }
 
-// StopInventory signals the inventory service to exit gracefully
+// flush writes the inventory to the datastore if it has pending operations
+// and reports whether it did
+func (inv *Inventory) flush() (bool, error) {
+	if atomic.LoadUint32(&inv.PendingOps) > 0 {
+		return true, inv.Save()
+	}
+	return false, nil
+}
+
+// StopInventory signals the inventory service to exit gracefully, see Close
 func (inv *Inventory) StopInventory() {
-	log.Printf("Shutdown request received. Signalling the routines to terminate")
-	inv.inventoryInactive <- true
-	sig := <-inv.inventoryInactive
-	if sig != true {
-		log.Fatalf("Error encountered while trying to shutdown the service")
+	if err := inv.Close(); err != nil {
+		Logf(LevelError, "Unable to close the inventory: %s", err)
 	}
 }
 
+// Close stops the flush service, writes the pending operations to the
+// datastore and releases the operation log and the store. The inventory
+// can't be changed afterwards. Closing it again is a no-op. If the final
+// write fails, the pending operations are still kept inside the operation
+// log and are replayed by the next Open.
+func (inv *Inventory) Close() error {
+	inv.closeOnce.Do(func() {
+		Logf(LevelInfo, "Shutdown request received. Signalling the routines to terminate")
+		inv.inventoryInactive <- true
+		<-inv.inventoryInactive
+		inv.closeErr = inv.Save()
+		if inv.opLog != nil {
+			if err := inv.opLog.close(); err != nil && inv.closeErr == nil {
+				inv.closeErr = &StorageError{Op: "close the operation log", Err: err}
+			}
+		}
+		if err := inv.store.Close(); err != nil && inv.closeErr == nil {
+			inv.closeErr = &StorageError{Op: "close the datastore", Err: err}
+		}
+	})
+	return inv.closeErr
+}
+
 // checkDatastorePath validates if a path provided exists on the disk or not
 func checkDatastorePath(path string) bool {
 	if _, err := os.Stat(path); err == nil {
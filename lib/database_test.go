@@ -3,7 +3,19 @@
 // which can be found in the LICENSE file.
 package inventory
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestGetHostName(t *testing.T) {
 	hostname := "m1.example.com"
@@ -75,11 +87,10 @@ func TestDeleteHost(t *testing.T) {
 	hostgroup.AddHost(host2)
 	hostgroup.DeleteHost(hostname1)
 	if val, ok := hostgroup.Hosts[hostname1]; ok {
-		if val != nil {
-			t.Errorf("Unable to delete the host from hostgroup %s", val)
-		}
-	} else {
-		t.Errorf("Unexpected error while trying to remove host from hostgroup")
+		t.Errorf("Unable to delete the host from hostgroup %v", val)
+	}
+	if _, ok := hostgroup.Hosts[hostname2]; !ok {
+		t.Errorf("Unexpected removal of another host from hostgroup")
 	}
 }
 
@@ -115,10 +126,10 @@ func TestGetHostgroupName(t *testing.T) {
 	}
 }
 
-func TestNewInventory(t *testing.T) {
-	dataStorePath := "/home/sbadhwar/upstream/data.db"
+func TestOpenInventory(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
 	var flushInterval uint16 = 5000
-	inventory := NewInventory(dataStorePath, flushInterval)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: flushInterval})
 	inventory.StopInventory()
 	if inventory == nil {
 		t.Errorf("Unable to construct a new inventory")
@@ -126,9 +137,9 @@ func TestNewInventory(t *testing.T) {
 }
 
 func TestNewHostgroup(t *testing.T) {
-	dataStorePath := "/home/sbadhwar/upstream/data.db"
+	dataStorePath := testDataStorePath(t)
 	var flushInterval uint16 = 5000
-	inventory := NewInventory(dataStorePath, flushInterval)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: flushInterval})
 	hostgroupName := "TestGroup"
 	inventory.NewHostgroup(hostgroupName)
 	inventory.StopInventory()
@@ -138,21 +149,21 @@ func TestNewHostgroup(t *testing.T) {
 }
 
 func TestGetHostgroup(t *testing.T) {
-	dataStorePath := "/home/sbadhwar/upstream/data.db"
+	dataStorePath := testDataStorePath(t)
 	var flushInterval uint16 = 5000
-	inventory := NewInventory(dataStorePath, flushInterval)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: flushInterval})
 	hostgroupName := "TestGroup"
 	inventory.NewHostgroup(hostgroupName)
 	inventory.StopInventory()
 	if inventory.GetHostgroup(hostgroupName) == nil {
 		t.Errorf("Unable to create a new hostgroup")
-	}	
+	}
 }
 
 func TestNewHost(t *testing.T) {
-	dataStorePath := "/home/sbadhwar/upstream/data.db"
+	dataStorePath := testDataStorePath(t)
 	var flushInterval uint16 = 5000
-	inventory := NewInventory(dataStorePath, flushInterval)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: flushInterval})
 	hostgroupName := "TestGroup"
 	hostname := "m1.example.com"
 	inventory.NewHostgroup(hostgroupName)
@@ -171,9 +182,9 @@ func TestNewHost(t *testing.T) {
 }
 
 func TestSetHostFact(t *testing.T) {
-	dataStorePath := "/home/sbadhwar/upstream/data.db"
+	dataStorePath := testDataStorePath(t)
 	var flushInterval uint16 = 5000
-	inventory := NewInventory(dataStorePath, flushInterval)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: flushInterval})
 	hostgroupName := "TestGroup"
 	hostname := "m1.example.com"
 	inventory.NewHostgroup(hostgroupName)
@@ -192,4 +203,550 @@ func TestSetHostFact(t *testing.T) {
 	if flag == false {
 		t.Errorf("Unable to add a new host to the hostgroup")
 	}
-}
\ No newline at end of file
+}
+
+func TestDeleteHostgroup(t *testing.T) {
+	inventory := newTestInventory()
+	hostgroupName := "TestGroup"
+	inventory.NewHost(hostgroupName, "m1.example.com")
+	if inventory.DeleteHostgroup(hostgroupName) != nil {
+		t.Errorf("Unable to delete the hostgroup")
+	}
+	if _, ok := inventory.Hostgroups[hostgroupName]; ok {
+		t.Errorf("Hostgroup still present after deletion")
+	}
+	if inventory.DeleteHostgroup(hostgroupName) == nil {
+		t.Errorf("Deleting a missing hostgroup should fail")
+	}
+}
+
+func TestDeleteHostFact(t *testing.T) {
+	inventory := newTestInventory()
+	hostgroupName := "TestGroup"
+	hostname := "m1.example.com"
+	inventory.NewHost(hostgroupName, hostname)
+	inventory.SetHostFact(hostgroupName, hostname, "testfact", "testval")
+	if inventory.DeleteHostFact(hostgroupName, hostname, "testfact") != nil {
+		t.Errorf("Unable to delete the host fact")
+	}
+	if inventory.DeleteHostFact(hostgroupName, hostname, "testfact") == nil {
+		t.Errorf("Deleting a missing fact should fail")
+	}
+	if inventory.DeleteHost(hostgroupName, hostname) != nil {
+		t.Errorf("Unable to delete the host")
+	}
+	if len(inventory.GetHosts(hostgroupName)) != 0 {
+		t.Errorf("Host still present after deletion")
+	}
+}
+
+func TestHostgroupVars(t *testing.T) {
+	hostgroup := NewHostGroup("TestGroup")
+	hostgroup.SetVar("test1", "value1")
+	hostgroup.SetVar("test2", "value2")
+	hostgroup.DeleteVar("test1")
+	vars := hostgroup.GetVars()
+	if _, ok := vars["test1"]; ok {
+		t.Errorf("Unable to delete the hostgroup variable")
+	}
+	if vars["test2"] != "value2" {
+		t.Errorf("Unable to set the hostgroup variable")
+	}
+}
+
+func TestSetHostgroupVar(t *testing.T) {
+	inventory := newTestInventory()
+	hostgroupName := "TestGroup"
+	if inventory.SetHostgroupVar(hostgroupName, "testvar", "testval") == nil {
+		t.Errorf("Setting a variable on a missing hostgroup should fail")
+	}
+	inventory.NewHostgroup(hostgroupName)
+	if inventory.SetHostgroupVar(hostgroupName, "testvar", "testval") != nil {
+		t.Errorf("Unable to set the hostgroup variable")
+	}
+	if inventory.DeleteHostgroupVar(hostgroupName, "testvar") != nil {
+		t.Errorf("Unable to delete the hostgroup variable")
+	}
+	if inventory.DeleteHostgroupVar(hostgroupName, "testvar") == nil {
+		t.Errorf("Deleting a missing hostgroup variable should fail")
+	}
+}
+
+func TestAddChildHostgroup(t *testing.T) {
+	inventory := newTestInventory()
+	inventory.NewHostgroup("prod")
+	inventory.NewHostgroup("prod-web")
+	inventory.NewHostgroup("prod-web-eu")
+	if err := inventory.AddChildHostgroup("prod", "prod-web"); err != nil {
+		t.Errorf("Unable to add a child hostgroup: %s", err)
+	}
+	if err := inventory.AddChildHostgroup("prod-web", "prod-web-eu"); err != nil {
+		t.Errorf("Unable to add a child hostgroup: %s", err)
+	}
+	if err := inventory.AddChildHostgroup("prod-web-eu", "prod"); err != ErrHostgroupCycle {
+		t.Errorf("Cyclic hierarchy was not rejected, got %v", err)
+	}
+	if err := inventory.AddChildHostgroup("prod", "prod"); err != ErrHostgroupCycle {
+		t.Errorf("Self nesting was not rejected, got %v", err)
+	}
+	if err := inventory.AddChildHostgroup("prod", "missing"); err != ErrHostgroupNotFound {
+		t.Errorf("Missing child hostgroup was not rejected, got %v", err)
+	}
+}
+
+func TestDeleteChildHostgroup(t *testing.T) {
+	inventory := newTestInventory()
+	inventory.NewHostgroup("prod")
+	inventory.NewHostgroup("prod-web")
+	inventory.NewHostgroup("prod-db")
+	inventory.AddChildHostgroup("prod", "prod-web")
+	inventory.AddChildHostgroup("prod", "prod-db")
+	inventory.DeleteHostgroup("prod-web")
+	children := inventory.GetHostgroup("prod").GetChildren()
+	if len(children) != 1 || children[0] != "prod-db" {
+		t.Errorf("Deleted hostgroup still referenced as a child, got %v", children)
+	}
+	if inventory.RemoveChildHostgroup("prod", "prod-db") != nil {
+		t.Errorf("Unable to remove the child hostgroup")
+	}
+	if inventory.GetHostgroup("prod-db") == nil {
+		t.Errorf("Removing a child should not delete the hostgroup")
+	}
+}
+
+func TestGetHostgroupVars(t *testing.T) {
+	inventory := newTestInventory()
+	inventory.NewHostgroup("prod")
+	inventory.NewHostgroup("prod-web")
+	inventory.NewHostgroup("web")
+	inventory.AddChildHostgroup("prod", "prod-web")
+	inventory.AddChildHostgroup("web", "prod-web")
+	inventory.SetHostgroupVar("prod", "env", "production")
+	inventory.SetHostgroupVar("prod", "port", "80")
+	inventory.SetHostgroupVar("web", "port", "8080")
+	inventory.SetHostgroupVar("prod-web", "role", "frontend")
+	vars := inventory.GetHostgroupVars("prod-web")
+	if vars["env"] != "production" || vars["role"] != "frontend" {
+		t.Errorf("Hostgroup variables were not inherited, got %v", vars)
+	}
+	// parents at the same depth are applied in the order of their names
+	if vars["port"] != "8080" {
+		t.Errorf("Hostgroup variable precedence is wrong, got %s", vars["port"])
+	}
+	inventory.SetHostgroupVar("prod-web", "port", "443")
+	if inventory.GetHostgroupVars("prod-web")["port"] != "443" {
+		t.Errorf("Child hostgroup variables should override the parent ones")
+	}
+}
+
+func TestHostInMultipleHostgroups(t *testing.T) {
+	inventory := newTestInventory()
+	hostname := "m1.example.com"
+	inventory.NewHost("web", hostname)
+	inventory.NewHost("db", hostname)
+	inventory.SetHostFact("web", hostname, "testfact", "testval")
+	if inventory.Hostgroups["db"].Hosts[hostname] != inventory.Hostgroups["web"].Hosts[hostname] {
+		t.Errorf("Host is not shared between its hostgroups")
+	}
+	if inventory.GetHosts("db")[hostname].Facts["testfact"] != "testval" {
+		t.Errorf("Host fact was not applied to the shared host")
+	}
+	inventory.DeleteHost("web", hostname)
+	if inventory.GetHost(hostname) == nil {
+		t.Errorf("Host removed while still belonging to another hostgroup")
+	}
+	inventory.DeleteHostgroup("db")
+	if inventory.GetHost(hostname) != nil {
+		t.Errorf("Host kept after being removed from all of its hostgroups")
+	}
+}
+
+func TestHostgroupMembership(t *testing.T) {
+	inventory := newTestInventory()
+	hostname := "m1.example.com"
+	inventory.NewHost("web", hostname)
+	inventory.NewHostgroup("db")
+	if err := inventory.AddHostToHostgroup("db", hostname); err != nil {
+		t.Errorf("Unable to add the host to another hostgroup: %s", err)
+	}
+	if err := inventory.AddHostToHostgroup("db", "missing"); err != ErrHostNotFound {
+		t.Errorf("Adding a missing host should fail, got %v", err)
+	}
+	if err := inventory.AddHostToHostgroup("missing", hostname); err != ErrHostgroupNotFound {
+		t.Errorf("Adding to a missing hostgroup should fail, got %v", err)
+	}
+	inventory.RemoveHostFromHostgroup("web", hostname)
+	inventory.RemoveHostFromHostgroup("db", hostname)
+	ungrouped := inventory.GetUngroupedHosts()
+	if len(ungrouped) != 1 || ungrouped[0] != hostname {
+		t.Errorf("Host removed from all hostgroups should be ungrouped, got %v", ungrouped)
+	}
+	if inventory.PurgeHost(hostname) != nil || inventory.GetHost(hostname) != nil {
+		t.Errorf("Unable to purge the host")
+	}
+}
+
+func TestHostgroupJSON(t *testing.T) {
+	legacy := `{"Hostgroups":{"web":{"Name":"web","Hosts":{"m1":{"Hostname":"m1","Facts":{"a":"1"}},"m2":null}},` +
+		`"db":{"Name":"db","Hosts":{"m1":{"Hostname":"m1","Facts":{"b":"2"}}}}}}`
+	var inventory *Inventory
+	if err := json.Unmarshal([]byte(legacy), &inventory); err != nil {
+		t.Fatalf("Unable to decode the legacy inventory: %s", err)
+	}
+	inventory.linkHosts()
+	host := inventory.GetHost("m1")
+	if host == nil || host.Facts["a"] != "1" || host.Facts["b"] != "2" {
+		t.Fatalf("Legacy hosts were not merged into the registry, got %v", host)
+	}
+	if inventory.GetHostgroup("web").GetHost("m2") != nil {
+		t.Errorf("Deleted legacy host was restored")
+	}
+	data, err := json.Marshal(inventory)
+	if err != nil {
+		t.Fatalf("Unable to encode the inventory: %s", err)
+	}
+	var reloaded *Inventory
+	json.Unmarshal(data, &reloaded)
+	reloaded.linkHosts()
+	if reloaded.Hostgroups["web"].Hosts["m1"] != reloaded.Hostgroups["db"].Hosts["m1"] {
+		t.Errorf("Reloaded host is not shared between its hostgroups")
+	}
+}
+
+func TestConcurrentInventoryAccess(t *testing.T) {
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 1})
+	defer inventory.StopInventory()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			hostgroupName := fmt.Sprintf("group%d", worker%3)
+			for j := 0; j < 200; j++ {
+				hostname := fmt.Sprintf("m%d.example.com", j%20)
+				inventory.NewHost(hostgroupName, hostname)
+				inventory.SetHostFact("", hostname, "worker", worker)
+				inventory.SetHostgroupVar(hostgroupName, "iteration", j)
+				inventory.AddChildHostgroup("group0", hostgroupName)
+				inventory.GetHosts(hostgroupName)
+				inventory.GetHostgroupVars(hostgroupName)
+				inventory.GetAnsibleInventory()
+				if j%10 == 0 {
+					inventory.DeleteHost(hostgroupName, hostname)
+					inventory.Save()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(inventory.GetInventory()) != 3 {
+		t.Errorf("Concurrent access lost hostgroups, got %d", len(inventory.GetInventory()))
+	}
+}
+
+// testDataStorePath provides a datastore path which is cleaned up with the test
+func testDataStorePath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "data.db")
+}
+
+// openTestInventory opens the inventory with the options
+func openTestInventory(t *testing.T, opts Options) *Inventory {
+	inventory, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Unable to open the inventory: %s", err)
+	}
+	return inventory
+}
+
+// newTestInventory creates an inventory which is not backed by a datastore
+func newTestInventory() *Inventory {
+	return &Inventory{Hostgroups: make(map[string]*HostGroup), Hosts: make(map[string]*Host)}
+}
+
+func TestCapacity(t *testing.T) {
+	inventory := newTestInventory()
+	inventory.NewHost("web", "m0")
+	inventory.NewHost("db", "db1")
+	for i := len(inventory.Hostgroups); i < InventoryCapacity; i++ {
+		name := fmt.Sprintf("hg%d", i)
+		inventory.Hostgroups[name] = NewHostGroup(name)
+	}
+	web := inventory.Hostgroups["web"]
+	for i := len(web.Hosts); i < HostgroupCapacity; i++ {
+		web.AddHost(NewHost(fmt.Sprintf("m%d", i)))
+	}
+
+	if err := inventory.NewHostgroup("cache"); err != ErrCapacityExceeded {
+		t.Errorf("Hostgroup above the inventory capacity was created, got %v", err)
+	}
+	if err := inventory.NewHost("cache", "c1"); err != ErrCapacityExceeded {
+		t.Errorf("Host created a hostgroup above the inventory capacity, got %v", err)
+	}
+	if err := inventory.NewHost("web", "m-extra"); err != ErrCapacityExceeded {
+		t.Errorf("Host above the hostgroup capacity was created, got %v", err)
+	}
+	if err := inventory.AddHostToHostgroup("web", "db1"); err != ErrCapacityExceeded {
+		t.Errorf("Host above the hostgroup capacity was added, got %v", err)
+	}
+	if inventory.GetHostgroup("cache") != nil || inventory.GetHost("c1") != nil || inventory.GetHost("m-extra") != nil {
+		t.Errorf("Rejected operations changed the inventory")
+	}
+	// Existing hostgroups and memberships don't need any room
+	if err := inventory.NewHostgroup("web"); err != nil {
+		t.Errorf("Existing hostgroup was rejected: %s", err)
+	}
+	if err := inventory.NewHost("web", "m0"); err != nil {
+		t.Errorf("Existing member was rejected: %s", err)
+	}
+	if err := inventory.NewHost("db", "db2"); err != nil {
+		t.Errorf("Host below the hostgroup capacity was rejected: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	writeInventoryError(rec, ErrCapacityExceeded)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), errCodeCapacity) {
+		t.Errorf("Exceeded capacity was not reported as a conflict, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTypedHostFacts(t *testing.T) {
+	inventory := newTestInventory()
+	hostname := "m1.example.com"
+	inventory.NewHost("web", hostname)
+	inventory.SetHostFact("web", hostname, "ansible_port", json.Number("2222"))
+	inventory.SetHostFact("web", hostname, "ntp_servers", []interface{}{"ntp1", "ntp2"})
+	inventory.SetHostFact("web", hostname, "legacy", "value")
+	data, err := json.Marshal(inventory)
+	if err != nil {
+		t.Fatalf("Unable to encode the inventory: %s", err)
+	}
+	var reloaded *Inventory
+	if err := decodeJSON(data, &reloaded); err != nil {
+		t.Fatalf("Unable to decode the inventory: %s", err)
+	}
+	reloaded.linkHosts()
+	facts := reloaded.GetHost(hostname).GetHostFacts()
+	if facts["ansible_port"] != json.Number("2222") {
+		t.Errorf("Numeric fact was not preserved, got %#v", facts["ansible_port"])
+	}
+	if servers, ok := facts["ntp_servers"].([]interface{}); !ok || len(servers) != 2 {
+		t.Errorf("List fact was not preserved, got %#v", facts["ntp_servers"])
+	}
+	if facts["legacy"] != "value" {
+		t.Errorf("String fact was not preserved, got %#v", facts["legacy"])
+	}
+}
+
+func TestFlushOnlyPendingOperations(t *testing.T) {
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 10})
+	defer inventory.StopInventory()
+	time.Sleep(50 * time.Millisecond)
+	if !inventory.GetFlushStats().LastFlush.IsZero() {
+		t.Errorf("Inventory was flushed without any pending operations")
+	}
+	inventory.NewHostgroup("web")
+	time.Sleep(50 * time.Millisecond)
+	if inventory.GetFlushStats().LastFlush.IsZero() {
+		t.Errorf("Pending operations were not flushed")
+	}
+	if atomic.LoadUint32(&inventory.PendingOps) != 0 {
+		t.Errorf("Pending operations were not reset after the flush")
+	}
+}
+
+func TestFlushThreshold(t *testing.T) {
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000, FlushThreshold: 3})
+	defer inventory.StopInventory()
+	inventory.NewHostgroup("web")
+	inventory.NewHostgroup("db")
+	time.Sleep(50 * time.Millisecond)
+	if !inventory.GetFlushStats().LastFlush.IsZero() {
+		t.Errorf("Inventory was flushed before reaching the threshold")
+	}
+	inventory.NewHostgroup("cache")
+	time.Sleep(50 * time.Millisecond)
+	if inventory.GetFlushStats().LastFlush.IsZero() {
+		t.Errorf("Inventory was not flushed after reaching the threshold")
+	}
+}
+
+func TestSetFlushSettings(t *testing.T) {
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000})
+	defer inventory.StopInventory()
+	inventory.NewHostgroup("web")
+	inventory.SetFlushSettings(10, 0)
+	time.Sleep(100 * time.Millisecond)
+	if inventory.GetFlushStats().LastFlush.IsZero() {
+		t.Errorf("Inventory was not flushed at the new interval")
+	}
+	inventory.SetFlushSettings(60000, 1)
+	inventory.NewHostgroup("db")
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadUint32(&inventory.PendingOps) != 0 {
+		t.Errorf("Inventory was not flushed at the new threshold")
+	}
+}
+
+func TestGetAnsibleHostVars(t *testing.T) {
+	inventory := newTestInventory()
+	hostname := "m1.example.com"
+	inventory.NewHost("prod-web", hostname)
+	inventory.NewHostgroup("prod")
+	inventory.AddChildHostgroup("prod", "prod-web")
+	inventory.SetHostgroupVar("prod", "env", "prod")
+	inventory.SetHostgroupVar("prod", "port", 80)
+	inventory.SetHostgroupVar("prod-web", "port", 8080)
+	inventory.SetHostFact("", hostname, "env", "staging")
+	vars := inventory.GetAnsibleHostVars(hostname)
+	if vars["port"] != 8080 {
+		t.Errorf("Child hostgroup variable should override the parent, got %v", vars["port"])
+	}
+	if vars["env"] != "staging" {
+		t.Errorf("Host fact should override the hostgroup variables, got %v", vars["env"])
+	}
+	if inventory.GetAnsibleHostVars("missing") != nil {
+		t.Errorf("Missing host should not have any variables")
+	}
+}
+
+func TestOpenRestart(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt, BackendSQLite} {
+		dir := t.TempDir()
+		opts := Options{
+			Backend:       backend,
+			BackendPath:   filepath.Join(dir, "inventory."+backend),
+			DataStorePath: filepath.Join(dir, "data.db"),
+			FlushInterval: 60000,
+		}
+		first, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: unable to open the inventory: %s", backend, err)
+		}
+		first.NewHost("web", "m1.example.com")
+		first.SetHostFact("", "m1.example.com", "cpus", 4)
+		if err := first.Close(); err != nil {
+			t.Fatalf("%s: unable to close the inventory: %s", backend, err)
+		}
+
+		// The reloaded inventory takes its settings from the options
+		opts.FlushInterval = 10
+		opts.FlushThreshold = 5
+		second, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: unable to reopen the inventory: %s", backend, err)
+		}
+		if host := second.GetHost("m1.example.com"); host == nil || host.Facts["cpus"] == nil {
+			t.Errorf("%s: inventory was not reloaded", backend)
+		}
+		if second.FlushInterval != 10 || second.FlushThreshold != 5 || second.DataStorePath != opts.DataStorePath {
+			t.Errorf("%s: persisted settings took precedence over the options", backend)
+		}
+		second.NewHost("db", "m2.example.com")
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadUint32(&second.PendingOps) != 0 {
+			t.Errorf("%s: reloaded inventory was not flushed", backend)
+		}
+		closed := make(chan error, 1)
+		go func() { closed <- second.Close() }()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("%s: unable to close the reloaded inventory: %s", backend, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: closing the reloaded inventory blocked", backend)
+		}
+
+		third, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: unable to reopen the inventory: %s", backend, err)
+		}
+		if third.GetHost("m1.example.com") == nil || third.GetHost("m2.example.com") == nil {
+			t.Errorf("%s: changes made after the restart were lost", backend)
+		}
+		third.Close()
+	}
+}
+
+// flakyStore fails the saves while failing is set
+type flakyStore struct {
+	Store
+	failing int32
+}
+
+func (s *flakyStore) Save(inv *Inventory, changes *Changeset) error {
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return errors.New("no space left on device")
+	}
+	return s.Store.Save(inv, changes)
+}
+
+// makeFlaky replaces the store of the inventory with a failing one
+func makeFlaky(inventory *Inventory) *flakyStore {
+	inventory.datastoreLock.Lock()
+	defer inventory.datastoreLock.Unlock()
+	store := &flakyStore{Store: inventory.store, failing: 1}
+	inventory.store = store
+	return store
+}
+
+func TestFlushRetry(t *testing.T) {
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 10, MaxPendingOps: 2})
+	defer inventory.StopInventory()
+	store := makeFlaky(inventory)
+	inventory.NewHostgroup("web")
+	time.Sleep(50 * time.Millisecond)
+	stats := inventory.GetFlushStats()
+	if !stats.Degraded() || !strings.Contains(stats.LastError, "no space left") {
+		t.Errorf("Failed write was not reported, got %+v", stats)
+	}
+	if err := inventory.NewHostgroup("db"); err != nil {
+		t.Errorf("Operation below the limit was rejected: %s", err)
+	}
+	if err := inventory.NewHostgroup("cache"); err != ErrTooManyPendingOps {
+		t.Errorf("Operation above the limit was not rejected, got %v", err)
+	}
+
+	atomic.StoreInt32(&store.failing, 0)
+	for i := 0; i < 40 && inventory.GetFlushStats().Degraded(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if inventory.GetFlushStats().Degraded() || atomic.LoadUint32(&inventory.PendingOps) != 0 {
+		t.Fatalf("Failed write was not retried")
+	}
+	if err := inventory.NewHostgroup("cache"); err != nil {
+		t.Errorf("Operation was rejected after the recovery: %s", err)
+	}
+}
+
+func TestCloseWriteFailure(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 60000})
+	makeFlaky(inventory)
+	inventory.NewHostgroup("web")
+	err := inventory.Close()
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) {
+		t.Fatalf("Failed final write was not reported, got %v", err)
+	}
+	// The operation log still holds the operations which were not written
+	reloaded := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 60000})
+	defer reloaded.StopInventory()
+	if reloaded.GetHostgroup("web") == nil {
+		t.Errorf("Operation was lost after the failed write")
+	}
+}
+
+func TestNextFlushBackoff(t *testing.T) {
+	backoff := time.Duration(0)
+	for i := 0; i < 20; i++ {
+		next := nextFlushBackoff(backoff)
+		if next < backoff || next < flushRetryMinBackoff || next > flushRetryMaxBackoff {
+			t.Fatalf("Unexpected backoff %s after %s", next, backoff)
+		}
+		backoff = next
+	}
+	if backoff != flushRetryMaxBackoff {
+		t.Errorf("Backoff didn't reach its maximum, got %s", backoff)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DatastoreBackups defines the number of previous generations of the
+// datastore which are kept next to it as <datastore>.1 (the newest)
+// up to <datastore>.N (the oldest).
+const DatastoreBackups = 3
+
+// writeDatastore atomically replaces the datastore with the provided data.
+// The data is written to a temporary file inside the same directory, synced
+// to the disk and then renamed over the datastore, so that a crash at any
+// point leaves either the old or the new datastore behind, but never a
+// truncated one. The replaced datastore is kept as the newest backup.
+func writeDatastore(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	// Clean up the temporary file on any failure, after a successful rename
+	// it doesn't exists anymore and the removal is a no-op
+	defer os.Remove(tmpPath)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := rotateBackups(path); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts the backups of the datastore by one generation and
+// keeps the current datastore as the newest backup. An empty datastore, as
+// created on the first start, is not worth a backup.
+func rotateBackups(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return nil
+	}
+	for i := DatastoreBackups - 1; i > 0; i-- {
+		err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	newest := backupPath(path, 1)
+	os.Remove(newest)
+	// A hard link keeps the datastore in place until the new one is renamed
+	// over it, fall back to copying on filesystems without hard links.
+	if err := os.Link(path, newest); err != nil {
+		return copyFile(path, newest)
+	}
+	return nil
+}
+
+// backupPath returns the path of the backup of the datastore for the
+// provided generation.
+func backupPath(path string, generation int) string {
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+// copyFile copies the file at src to dst and syncs it to the disk
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes the directory entries to the disk so that a rename
+// inside the directory survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadDatastore reads the inventory from the datastore. If the datastore is
+// corrupt, the newest valid backup is used instead. An empty datastore
+// without any backups is a freshly created one, in which case the call
+// returns a nil inventory without an error.
+func loadDatastore(path string) (*Inventory, error) {
+	inv, err := decodeDatastore(path)
+	if err == nil && inv != nil {
+		return inv, nil
+	}
+	if err != nil {
+		Logf(LevelWarning, "the datastore %s is corrupt: %s", path, err)
+	}
+	for i := 1; i <= DatastoreBackups; i++ {
+		backup := backupPath(path, i)
+		if !checkDatastorePath(backup) {
+			continue
+		}
+		binv, berr := decodeDatastore(backup)
+		if berr != nil || binv == nil {
+			Logf(LevelWarning, "skipping the unusable datastore backup %s", backup)
+			continue
+		}
+		Logf(LevelWarning, "the datastore %s is unusable, falling back to the backup %s. "+
+			"Changes made after the backup was taken are lost", path, backup)
+		return binv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no valid datastore or backup found for %s: %s", path, err)
+	}
+	return nil, nil
+}
+
+// decodeDatastore decodes the inventory stored in the file. An empty file
+// results in a nil inventory.
+func decodeDatastore(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var inv *Inventory
+	if err := decodeJSON(data, &inv); err != nil {
+		return nil, err
+	}
+	if inv == nil {
+		return nil, fmt.Errorf("datastore doesn't contain an inventory")
+	}
+	inv.linkHosts()
+	return inv, nil
+}
@@ -0,0 +1,67 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDatastoreBackups(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	generations := []string{"gen1", "gen2", "gen3", "gen4", "gen5"}
+	for _, data := range generations {
+		if err := writeDatastore(dataStorePath, []byte(data)); err != nil {
+			t.Fatalf("Unable to write the datastore: %s", err)
+		}
+	}
+	data, _ := ioutil.ReadFile(dataStorePath)
+	if string(data) != "gen5" {
+		t.Errorf("Datastore holds the wrong generation, got %s", data)
+	}
+	for i := 1; i <= DatastoreBackups; i++ {
+		data, err := ioutil.ReadFile(backupPath(dataStorePath, i))
+		if err != nil || string(data) != generations[len(generations)-1-i] {
+			t.Errorf("Backup %d holds the wrong generation, got %s", i, data)
+		}
+	}
+	if checkDatastorePath(backupPath(dataStorePath, DatastoreBackups+1)) {
+		t.Errorf("More backups kept than configured")
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dataStorePath), "*.tmp*"))
+	if len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+}
+
+func TestCorruptDatastoreFallback(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 5000})
+	inventory.NewHost("TestGroup", "m1.example.com")
+	inventory.StopInventory()
+	// the next write makes the saved inventory the newest backup
+	if err := writeDatastore(dataStorePath, []byte(`{"Hostgroups": {"Test`)); err != nil {
+		t.Fatalf("Unable to write the datastore: %s", err)
+	}
+	reloaded, err := loadDatastore(dataStorePath)
+	if err != nil {
+		t.Fatalf("Unable to fall back to the backup: %s", err)
+	}
+	if reloaded.GetHost("m1.example.com") == nil {
+		t.Errorf("Backup was not used while reloading the inventory")
+	}
+}
+
+func TestCorruptDatastoreWithoutBackups(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	ioutil.WriteFile(dataStorePath, []byte(`{"Hostgroups": {"Test`), 0644)
+	if _, err := loadDatastore(dataStorePath); err == nil {
+		t.Errorf("Corrupt datastore without backups was accepted")
+	}
+	ioutil.WriteFile(dataStorePath, []byte{}, 0644)
+	if inv, err := loadDatastore(dataStorePath); inv != nil || err != nil {
+		t.Errorf("Empty datastore should be treated as a fresh one")
+	}
+}
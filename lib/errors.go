@@ -0,0 +1,55 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrHostgroupNotFound is returned when the requested hostgroup
+	// doesn't exists in the inventory.
+	ErrHostgroupNotFound = errors.New("hostgroup not found")
+	// ErrHostNotFound is returned when the requested host doesn't
+	// exists in the inventory.
+	ErrHostNotFound = errors.New("host not found")
+	// ErrFactNotFound is returned when the requested fact isn't set
+	// on the host.
+	ErrFactNotFound = errors.New("fact not found")
+	// ErrVarNotFound is returned when the requested variable isn't set
+	// on the hostgroup.
+	ErrVarNotFound = errors.New("hostgroup variable not found")
+	// ErrHostgroupCycle is returned when adding a child hostgroup would
+	// make the hostgroup hierarchy cyclic.
+	ErrHostgroupCycle = errors.New("hostgroup hierarchy would contain a cycle")
+	// ErrCapacityExceeded is returned when a hostgroup would hold more than
+	// HostgroupCapacity hosts, or the inventory more than InventoryCapacity
+	// hostgroups.
+	ErrCapacityExceeded = errors.New("capacity of the hostgroup or the inventory exceeded")
+	// ErrTooManyPendingOps is returned when the inventory already holds the
+	// maximum number of operations which are not yet written to the
+	// datastore, which happens once the datastore can't be written.
+	ErrTooManyPendingOps = errors.New("too many operations pending to be written to the datastore")
+)
+
+// StorageError is returned when the datastore or the operation log can't be
+// read or written. The underlying error is available through errors.As and
+// errors.Unwrap.
+type StorageError struct {
+	// Op describes what was being done with the storage
+	Op string
+	// Err is the error returned by the storage
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("unable to %s: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the error returned by the storage
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
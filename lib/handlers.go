@@ -7,90 +7,394 @@ package inventory
 import (
 	//"os"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	//"github.com/gorilla/mux"
-)
+	"sync/atomic"
 
-var (
-	inv *Inventory
+	"github.com/gorilla/mux"
 )
 
 func ping(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", "Pong")
 }
 
-func createHostgroup(w http.ResponseWriter, r *http.Request) {
-	var params map[string]string
-	json.NewDecoder(r.Body).Decode(&params)
-	if hgname, ok := params["hostgroup"]; ok {
-		inv.NewHostgroup(hgname)
-		w.WriteHeader(http.StatusCreated)
-		return
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	stats := s.inv.GetFlushStats()
+	health := "ok"
+	if stats.Degraded() {
+		health = "degraded"
+	}
+	status := map[string]interface{}{
+		"health":                 health,
+		"pending_ops":            atomic.LoadUint32(&s.inv.PendingOps),
+		"last_flush":             stats.LastFlush,
+		"last_flush_duration_ms": stats.LastFlushDuration.Seconds() * 1000,
+		"flush_failures":         stats.Failures,
 	}
-	w.WriteHeader(http.StatusInternalServerError)
-	return
+	if stats.LastError != "" {
+		status["last_flush_error"] = stats.LastError
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// maxRequestBodySize limits the request bodies accepted by the API
+const maxRequestBodySize = 1 << 20
+
+// The codes identifying the errors inside the error responses
+const (
+	errCodeMalformedBody = "malformed_body"
+	errCodeBodyTooLarge  = "body_too_large"
+	errCodeMissingField  = "missing_field"
+	errCodeInvalidField  = "invalid_field"
+	errCodeNotFound      = "not_found"
+	errCodeConflict      = "conflict"
+	errCodeMethod        = "method_not_allowed"
+	errCodeUnauthorized  = "unauthorized"
+	errCodeForbidden     = "forbidden"
+	errCodeCapacity      = "capacity_exceeded"
+	errCodePendingOps    = "too_many_pending_ops"
+	errCodeStorage       = "storage_error"
+	errCodeInternal      = "internal_error"
+)
+
+// apiError describes why a request failed. It is sent to the client
+// wrapped inside an object under the error key.
+type apiError struct {
+	// Code identifies the kind of the error
+	Code string `json:"code"`
+	// Message describes the error to a human
+	Message string `json:"message"`
+	// Field names the request parameter which caused the error, if any
+	Field string `json:"field,omitempty"`
+}
+
+// writeError writes the error response with the status
+func writeError(w http.ResponseWriter, status int, code string, message string, field string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{
+		"error": {Code: code, Message: message, Field: field},
+	})
+}
+
+// inventoryErrorFields names the parameter each inventory error is about
+var inventoryErrorFields = map[error]string{
+	ErrHostgroupNotFound: "hostgroup",
+	ErrHostNotFound:      "hostname",
+	ErrFactNotFound:      "fact",
+	ErrVarNotFound:       "var",
+	ErrHostgroupCycle:    "child",
 }
 
-func createHost(w http.ResponseWriter, r *http.Request) {
-	var params map[string]string
-	json.NewDecoder(r.Body).Decode(&params)
-	if hgname, ok := params["hostgroup"]; ok {
-		if hname, ok := params["hostname"]; ok {
-			inv.NewHost(hgname, hname)
-			w.WriteHeader(http.StatusCreated)
+// writeInventoryError maps the errors returned by the inventory to the
+// matching HTTP status and writes them as the response.
+func writeInventoryError(w http.ResponseWriter, err error) {
+	field := inventoryErrorFields[err]
+	switch err {
+	case ErrHostgroupNotFound, ErrHostNotFound, ErrFactNotFound, ErrVarNotFound:
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error(), field)
+	case ErrHostgroupCycle:
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error(), field)
+	case ErrCapacityExceeded:
+		writeError(w, http.StatusConflict, errCodeCapacity, err.Error(), "")
+	case ErrTooManyPendingOps:
+		writeError(w, http.StatusServiceUnavailable, errCodePendingOps, err.Error(), "")
+	default:
+		var storageErr *StorageError
+		if errors.As(err, &storageErr) {
+			writeError(w, http.StatusServiceUnavailable, errCodeStorage, err.Error(), "")
 			return
 		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error(), "")
+	}
+}
+
+// notFound answers the requests which don't match any endpoint
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, errCodeNotFound, "no such endpoint", "")
+}
+
+// methodNotAllowed answers the requests made with a method the endpoint
+// doesn't support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, errCodeMethod, "method not allowed", "")
+}
+
+// decodeParams decodes the JSON object inside the request body. Numbers are
+// kept as json.Number so that they are neither stringified nor lose their
+// precision. On failure, the error response is written and false returned.
+func decodeParams(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		if isBodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", maxRequestBodySize), "")
+			return nil, false
+		}
+		writeError(w, http.StatusBadRequest, errCodeMalformedBody, err.Error(), "")
+		return nil, false
+	}
+	var params map[string]interface{}
+	if err := decodeJSON(data, &params); err != nil || params == nil {
+		writeError(w, http.StatusBadRequest, errCodeMalformedBody, "request body needs to be a JSON object", "")
+		return nil, false
+	}
+	return params, true
+}
+
+// isBodyTooLarge checks if reading the body failed on the size limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// stringParam returns the parameter which needs to be a non empty string.
+// An optional parameter which is missing is returned as an empty string.
+// On failure, the error response is written and false returned.
+func stringParam(w http.ResponseWriter, params map[string]interface{}, name string, required bool) (string, bool) {
+	value, ok := params[name]
+	if !ok {
+		if required {
+			writeError(w, http.StatusBadRequest, errCodeMissingField, name+" is required", name)
+			return "", false
+		}
+		return "", true
+	}
+	str, ok := value.(string)
+	if !ok || str == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidField, name+" needs to be a non empty string", name)
+		return "", false
 	}
-	w.WriteHeader(http.StatusInternalServerError)
+	return str, true
 }
 
-func setHostFact(w http.ResponseWriter, r *http.Request) {
-	var params map[string]string
-	json.NewDecoder(r.Body).Decode(&params)
-	hostgroup, hgok := params["hostgroup"]
-	hostname, hok := params["hostname"]
-	if !hgok || !hok {
-		w.WriteHeader(http.StatusBadRequest)
+func (s *Server) createHostgroup(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
+	}
+	hgname, ok := stringParam(w, params, "hostgroup", true)
+	if !ok {
+		return
+	}
+	if err := s.inv.NewHostgroup(hgname); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) createHost(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
+	}
+	hgname, ok := stringParam(w, params, "hostgroup", true)
+	if !ok {
+		return
+	}
+	hname, ok := stringParam(w, params, "hostname", true)
+	if !ok {
+		return
+	}
+	if err := s.inv.NewHost(hgname, hname); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) setHostFact(w http.ResponseWriter, r *http.Request) {
+	// Facts can carry any JSON value
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
+	}
+	// The hostgroup is optional since the facts are shared by all the
+	// hostgroups of the host
+	hostgroup, ok := stringParam(w, params, "hostgroup", false)
+	if !ok {
+		return
+	}
+	hostname, ok := stringParam(w, params, "hostname", true)
+	if !ok {
+		return
 	}
 	delete(params, "hostgroup")
 	delete(params, "hostname")
-	for f, v := range params {
-		ok := inv.SetHostFact(hostgroup, hostname, f, v)
-		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Unable to process the request. Please try again later"))
-			return
-		}
+	if len(params) == 0 {
+		writeError(w, http.StatusBadRequest, errCodeMissingField, "at least one fact is required", "")
+		return
+	}
+	if err := s.inv.SetHostFacts(hostgroup, hostname, params); err != nil {
+		writeInventoryError(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
 
-func getInventory(w http.ResponseWriter, r *http.Request) {
-	outputInvMap := make(map[string]interface{})
-	hostInventory := inv.GetInventory()
-	outputInvMap["_meta"] = make(map[string]interface{})
-	outputInvMap["_meta"].(map[string]interface{})["hostvars"] = make(map[string]interface{})
-	for hgname := range hostInventory {
-		outputInvMap[hgname] = make(map[string][]string)
-		outputInvMap[hgname].(map[string][]string)["hosts"] = make([]string, 0, 65000)
-		hosts := hostInventory[hgname].GetHosts()
-		for hostname := range hosts {
-			// We dynamically create a inventory as per ansible wants it to be
-			// this involves explicitly typecasting an interface value to map
-			// value and then allocating memory to that.
-			outputInvMap[hgname].(map[string][]string)["hosts"] = append(outputInvMap[hgname].(map[string][]string)["hosts"], hostname)
-			// Setup host facts in the inventory
-			outputInvMap["_meta"].(map[string]interface{})["hostvars"].(map[string]interface{})[hostname] = make(map[string]string)
-			// Assign the host facts to the inventory
-			outputInvMap["_meta"].(map[string]interface{})["hostvars"].(map[string]interface{})[hostname] = hosts[hostname].GetHostFacts()
-		}
+func (s *Server) setHostgroupVar(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
 	}
+	hostgroup, ok := stringParam(w, params, "hostgroup", true)
+	if !ok {
+		return
+	}
+	delete(params, "hostgroup")
+	if len(params) == 0 {
+		writeError(w, http.StatusBadRequest, errCodeMissingField, "at least one variable is required", "")
+		return
+	}
+	if err := s.inv.SetHostgroupVars(hostgroup, params); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) addChildHostgroup(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
+	}
+	hostgroup, ok := stringParam(w, params, "hostgroup", true)
+	if !ok {
+		return
+	}
+	child, ok := stringParam(w, params, "child", true)
+	if !ok {
+		return
+	}
+	if err := s.inv.AddChildHostgroup(hostgroup, child); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) addHostToHostgroup(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeParams(w, r)
+	if !ok {
+		return
+	}
+	hostgroup, ok := stringParam(w, params, "hostgroup", true)
+	if !ok {
+		return
+	}
+	hostname, ok := stringParam(w, params, "hostname", true)
+	if !ok {
+		return
+	}
+	if err := s.inv.AddHostToHostgroup(hostgroup, hostname); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) getInventory(w http.ResponseWriter, r *http.Request) {
+	outputInvMap := s.inv.GetAnsibleInventory()
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(outputInvMap)
 }
 
-func getHosts(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
-	w.Write([]byte("Pending implementation"))
+func (s *Server) getHosts(w http.ResponseWriter, r *http.Request) {
+	hgname := mux.Vars(r)["hostgroup"]
+	// Ansible expects a single group to be described by the list of its
+	// hosts along with the group variables, which lets a playbook target
+	// just one hostgroup instead of the complete inventory.
+	if r.URL.Query().Get("format") == "ansible" {
+		outputMap := s.inv.GetAnsibleHostgroup(hgname)
+		if outputMap == nil {
+			writeInventoryError(w, ErrHostgroupNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(outputMap)
+		return
+	}
+	hosts := s.inv.GetHosts(hgname)
+	if hosts == nil {
+		writeInventoryError(w, ErrHostgroupNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hosts)
+}
+
+func (s *Server) getHostVars(w http.ResponseWriter, r *http.Request) {
+	vars := s.inv.GetAnsibleHostVars(mux.Vars(r)["hostname"])
+	if vars == nil {
+		writeInventoryError(w, ErrHostNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vars)
+}
+
+func (s *Server) deleteHostgroup(w http.ResponseWriter, r *http.Request) {
+	hgname := mux.Vars(r)["hostgroup"]
+	if err := s.inv.DeleteHostgroup(hgname); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteHost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.inv.DeleteHost(vars["hostgroup"], vars["hostname"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteHostFact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.inv.DeleteHostFact(vars["hostgroup"], vars["hostname"], vars["fact"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteHostgroupVar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.inv.DeleteHostgroupVar(vars["hostgroup"], vars["var"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeChildHostgroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.inv.RemoveChildHostgroup(vars["hostgroup"], vars["child"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeHostFromHostgroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.inv.RemoveHostFromHostgroup(vars["hostgroup"], vars["hostname"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) purgeHost(w http.ResponseWriter, r *http.Request) {
+	if err := s.inv.PurgeHost(mux.Vars(r)["hostname"]); err != nil {
+		writeInventoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,218 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer opens the inventory with the options and creates its server.
+// The inventory is closed once the test is over.
+func newTestServer(t *testing.T, opts Options, serverOpts ServerOptions) *Server {
+	inventory := openTestInventory(t, opts)
+	server, err := NewServer(inventory, serverOpts)
+	if err != nil {
+		inventory.Close()
+		t.Fatalf("Unable to create the server: %s", err)
+	}
+	t.Cleanup(func() { inventory.Close() })
+	return server
+}
+
+func TestHandlerErrors(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{})
+	oversized := `{"hostgroup": "` + strings.Repeat("a", maxRequestBodySize) + `"}`
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		field  string
+	}{
+		{"POST", "/create/hostgroup", `{"hostgroup": `, http.StatusBadRequest, errCodeMalformedBody, ""},
+		{"POST", "/create/hostgroup", `["web"]`, http.StatusBadRequest, errCodeMalformedBody, ""},
+		{"POST", "/create/hostgroup", `{}`, http.StatusBadRequest, errCodeMissingField, "hostgroup"},
+		{"POST", "/create/hostgroup", `{"hostgroup": 5}`, http.StatusBadRequest, errCodeInvalidField, "hostgroup"},
+		{"POST", "/create/hostgroup", oversized, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, ""},
+		{"POST", "/create/hostgroup", `{"hostgroup": "web"}`, http.StatusCreated, "", ""},
+		{"POST", "/create/host", `{"hostgroup": "web"}`, http.StatusBadRequest, errCodeMissingField, "hostname"},
+		{"POST", "/create/host", `{"hostgroup": "web", "hostname": "m1"}`, http.StatusCreated, "", ""},
+		{"POST", "/create/fact", `{"hostname": "", "cpus": 4}`, http.StatusBadRequest, errCodeInvalidField, "hostname"},
+		{"POST", "/create/fact", `{"hostname": "m1"}`, http.StatusBadRequest, errCodeMissingField, ""},
+		{"POST", "/create/fact", `{"hostname": "m2", "cpus": 4}`, http.StatusNotFound, errCodeNotFound, "hostname"},
+		{"POST", "/create/fact", `{"hostgroup": "db", "hostname": "m1", "cpus": 4}`, http.StatusNotFound, errCodeNotFound, "hostgroup"},
+		{"POST", "/create/fact", `{"hostname": "m1", "cpus": 4}`, http.StatusCreated, "", ""},
+		{"POST", "/create/groupvar", `{"hostgroup": "db", "port": 80}`, http.StatusNotFound, errCodeNotFound, "hostgroup"},
+		{"POST", "/create/child", `{"hostgroup": "web", "child": "web"}`, http.StatusConflict, errCodeConflict, "child"},
+		{"GET", "/get/hosts/db", "", http.StatusNotFound, errCodeNotFound, "hostgroup"},
+		{"GET", "/get/host/m2", "", http.StatusNotFound, errCodeNotFound, "hostname"},
+		{"DELETE", "/delete/fact/web/m1/ram", "", http.StatusNotFound, errCodeNotFound, "fact"},
+		{"GET", "/get/everything", "", http.StatusNotFound, errCodeNotFound, ""},
+		{"GET", "/create/hostgroup", "", http.StatusMethodNotAllowed, errCodeMethod, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		name := test.method + " " + test.path + " " + test.body
+		if len(name) > 100 {
+			name = name[:100]
+		}
+		if rec.Code != test.status {
+			t.Errorf("%s: got %d, want %d", name, rec.Code, test.status)
+			continue
+		}
+		if test.code == "" {
+			continue
+		}
+		var envelope struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+			t.Errorf("%s: response is not an error envelope: %s", name, rec.Body.String())
+			continue
+		}
+		if envelope.Error.Code != test.code || envelope.Error.Field != test.field || envelope.Error.Message == "" {
+			t.Errorf("%s: got %+v, want the code %s and the field %q", name, envelope.Error, test.code, test.field)
+		}
+	}
+	if router.Inventory().GetHost("") != nil {
+		t.Errorf("Rejected request created a host without a name")
+	}
+}
+
+func TestGetHostsHandler(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{})
+	for _, req := range []struct {
+		path string
+		body string
+	}{
+		{"/create/hostgroup", `{"hostgroup": "all"}`},
+		{"/create/host", `{"hostgroup": "web", "hostname": "web01"}`},
+		{"/create/host", `{"hostgroup": "web", "hostname": "web02"}`},
+		{"/create/host", `{"hostgroup": "lb", "hostname": "lb01"}`},
+		{"/create/fact", `{"hostgroup": "web", "hostname": "web01", "os": "linux", "cpus": 4}`},
+		{"/create/groupvar", `{"hostgroup": "all", "ntp": "pool.ntp.org", "port": 80}`},
+		{"/create/groupvar", `{"hostgroup": "web", "port": 8080}`},
+		{"/create/child", `{"hostgroup": "all", "child": "web"}`},
+		{"/create/child", `{"hostgroup": "web", "child": "lb"}`},
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", req.path, strings.NewReader(req.body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Unable to POST %s %s, got %d %s", req.path, req.body, rec.Code, rec.Body.String())
+		}
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/get/hosts/web", `{
+			"web01": {"Hostname": "web01", "Facts": {"os": "linux", "cpus": 4}},
+			"web02": {"Hostname": "web02", "Facts": {}}
+		}`},
+		{"/get/hosts/web?format=ansible", `{
+			"hosts": ["web01", "web02"],
+			"vars": {"ntp": "pool.ntp.org", "port": 8080},
+			"children": ["lb"]
+		}`},
+		{"/get/hosts/lb?format=ansible", `{
+			"hosts": ["lb01"],
+			"vars": {"ntp": "pool.ntp.org", "port": 8080},
+			"children": []
+		}`},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", test.path, rec.Code)
+			continue
+		}
+		var got, expected interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("GET %s: response is not JSON: %s", test.path, err)
+			continue
+		}
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("GET %s: expected %v, got %v", test.path, expected, got)
+		}
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	t.Parallel()
+	router := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 10, MaxPendingOps: 1}, ServerOptions{})
+	store := makeFlaky(router.Inventory())
+	// The failing store has to recover for the API to stop cleanly
+	defer atomic.StoreInt32(&store.failing, 0)
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	if rec := request("POST", "/create/hostgroup", `{"hostgroup": "web"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Unable to create the hostgroup, got %d", rec.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var status map[string]interface{}
+	json.Unmarshal(request("GET", "/status", "").Body.Bytes(), &status)
+	if status["health"] != "degraded" || status["last_flush_error"] == nil {
+		t.Errorf("Failed write was not reported by the status, got %v", status)
+	}
+	rec := request("POST", "/create/hostgroup", `{"hostgroup": "db"}`)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), errCodePendingOps) {
+		t.Errorf("Operation above the limit was not rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServersWithPathPrefix(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/one", "/two"} {
+		server := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 60000}, ServerOptions{
+			PathPrefix: prefix,
+			Tokens:     []Token{{Name: "ci", Hash: HashToken("token"), Role: RoleWriter}},
+		})
+		mux.Handle(prefix+"/", server)
+	}
+	request := func(method string, path string, body string, token string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := request("GET", "/one/ping", "", ""); code != http.StatusOK {
+		t.Errorf("Ping under the prefix was not open, got %d", code)
+	}
+	if code := request("GET", "/one/get/inventory", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Request under the prefix was not authorized, got %d", code)
+	}
+	if code := request("POST", "/one/create/hostgroup", `{"hostgroup": "web"}`, "token"); code != http.StatusCreated {
+		t.Fatalf("Unable to create the hostgroup under the prefix, got %d", code)
+	}
+	if code := request("GET", "/one/get/hosts/web", "", "token"); code != http.StatusOK {
+		t.Errorf("Hostgroup was not created inside the first inventory, got %d", code)
+	}
+	if code := request("GET", "/two/get/hosts/web", "", "token"); code != http.StatusNotFound {
+		t.Errorf("Servers share their inventories, got %d", code)
+	}
+	if _, err := NewServer(nil, ServerOptions{PathPrefix: "inventory/"}); err == nil {
+		t.Errorf("Invalid path prefix was accepted")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel defines the severity of a log message. Messages below the
+// configured level are discarded.
+type LogLevel int32
+
+// The levels which can be configured through LogLevel
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// levelNames maps the configured names to the levels
+var levelNames = map[string]LogLevel{
+	"debug":   LevelDebug,
+	"info":    LevelInfo,
+	"warning": LevelWarning,
+	"error":   LevelError,
+}
+
+// slogLevels maps the levels to the ones written to the log
+var slogLevels = map[LogLevel]slog.Level{
+	LevelDebug:   slog.LevelDebug,
+	LevelInfo:    slog.LevelInfo,
+	LevelWarning: slog.LevelWarn,
+	LevelError:   slog.LevelError,
+}
+
+// LogFormat defines how the log records are written
+type LogFormat int32
+
+// The formats which can be configured through LogFormat
+const (
+	// FormatLogfmt writes every record as a line of key=value pairs
+	FormatLogfmt LogFormat = iota
+	// FormatJSON writes every record as a JSON object on its own line
+	FormatJSON
+)
+
+// formatNames maps the configured names to the formats
+var formatNames = map[string]LogFormat{
+	"logfmt": FormatLogfmt,
+	"json":   FormatJSON,
+}
+
+// Logger writes structured records at or above its level. A server can be
+// given its own logger, everything else logs through the package logger
+// which is configured through SetLogLevel and SetLogFormat.
+type Logger struct {
+	out    io.Writer
+	level  slog.LevelVar
+	logger atomic.Pointer[slog.Logger]
+}
+
+// NewLogger returns a logger writing the records in the format to out, or
+// to the output of the standard logger if out is nil
+func NewLogger(out io.Writer, format LogFormat, level LogLevel) *Logger {
+	if out == nil {
+		out = standardOutput{}
+	}
+	l := &Logger{out: out}
+	l.SetLevel(level)
+	l.SetFormat(format)
+	return l
+}
+
+// standardOutput writes to the current output of the standard logger, so
+// that log.SetOutput also redirects the package logger
+type standardOutput struct{}
+
+func (standardOutput) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// defaultLogger is the package logger
+var defaultLogger = NewLogger(nil, FormatLogfmt, LevelInfo)
+
+// SetLevel changes the level below which the messages are discarded, it
+// can be changed while logging
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Set(slogLevels[level])
+}
+
+// SetFormat changes the format of the records, it can be changed while
+// logging
+func (l *Logger) SetFormat(format LogFormat) {
+	opts := &slog.HandlerOptions{Level: &l.level}
+	var handler slog.Handler = slog.NewTextHandler(l.out, opts)
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(l.out, opts)
+	}
+	l.logger.Store(slog.New(handler))
+}
+
+// Logf writes the formatted message if the level is enabled
+func (l *Logger) Logf(level LogLevel, format string, v ...interface{}) {
+	logger := l.logger.Load()
+	if !logger.Enabled(context.Background(), slogLevels[level]) {
+		return
+	}
+	logger.Log(context.Background(), slogLevels[level], fmt.Sprintf(format, v...))
+}
+
+// Log writes the message along with the attributes, given as alternating
+// keys and values, if the level is enabled
+func (l *Logger) Log(level LogLevel, msg string, attrs ...interface{}) {
+	l.logger.Load().Log(context.Background(), slogLevels[level], msg, attrs...)
+}
+
+// ParseLogLevel returns the level with the name, one of debug, info, warning
+// or error. An empty name selects info.
+func ParseLogLevel(name string) (LogLevel, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warning or error", name)
+	}
+	return level, nil
+}
+
+// ParseLogFormat returns the format with the name, either logfmt or json.
+// An empty name selects logfmt.
+func ParseLogFormat(name string) (LogFormat, error) {
+	if name == "" {
+		return FormatLogfmt, nil
+	}
+	format, ok := formatNames[strings.ToLower(name)]
+	if !ok {
+		return FormatLogfmt, fmt.Errorf("unknown log format %q, expected logfmt or json", name)
+	}
+	return format, nil
+}
+
+// SetLogLevel changes the level of the package logger
+func SetLogLevel(level LogLevel) {
+	defaultLogger.SetLevel(level)
+}
+
+// SetLogFormat changes the format of the package logger
+func SetLogFormat(format LogFormat) {
+	defaultLogger.SetFormat(format)
+}
+
+// Logf writes the message through the package logger if the level is
+// enabled
+func Logf(level LogLevel, format string, v ...interface{}) {
+	defaultLogger.Logf(level, format, v...)
+}
+
+// Log writes the message along with the attributes through the package
+// logger if the level is enabled
+func Log(level LogLevel, msg string, attrs ...interface{}) {
+	defaultLogger.Log(level, msg, attrs...)
+}
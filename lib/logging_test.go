@@ -0,0 +1,63 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LevelInfo)
+
+	level, err := ParseLogLevel("Warning")
+	if err != nil || level != LevelWarning {
+		t.Fatalf("Unable to parse the log level: %v", err)
+	}
+	SetLogLevel(level)
+	Logf(LevelInfo, "hidden")
+	Logf(LevelWarning, "shown")
+	if strings.Contains(buf.String(), "hidden") {
+		t.Errorf("Message below the log level was written")
+	}
+	if !strings.Contains(buf.String(), "level=WARN msg=shown") {
+		t.Errorf("Message at the log level was not written, got %q", buf.String())
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("Unknown log level was accepted")
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, FormatJSON, LevelDebug)
+	logger.Log(LevelDebug, "flushed", "pending_ops", 3)
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Record is not JSON: %s, got %q", err, buf.String())
+	}
+	if record["level"] != "DEBUG" || record["msg"] != "flushed" || record["pending_ops"] != 3.0 {
+		t.Errorf("Record is missing its attributes, got %v", record)
+	}
+
+	buf.Reset()
+	logger.SetFormat(FormatLogfmt)
+	logger.Logf(LevelError, "unable to write %s", "inventory.db")
+	if !strings.Contains(buf.String(), `level=ERROR msg="unable to write inventory.db"`) {
+		t.Errorf("Record is not in the logfmt format, got %q", buf.String())
+	}
+	if format, err := ParseLogFormat("JSON"); err != nil || format != FormatJSON {
+		t.Errorf("Unable to parse the log format: %v", err)
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Errorf("Unknown log format was accepted")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of all the metrics
+const metricsNamespace = "bolt_inventory"
+
+// flushMetrics records the writes made by the flush service of an inventory
+type flushMetrics struct {
+	duration prometheus.Histogram
+	failures prometheus.Counter
+}
+
+// newFlushMetrics creates the unregistered flush metrics
+func newFlushMetrics() *flushMetrics {
+	return &flushMetrics{
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "flush_duration_seconds",
+			Help:      "Time taken by the writes of the inventory to the datastore.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "flush_failures_total",
+			Help:      "Writes of the inventory to the datastore which failed.",
+		}),
+	}
+}
+
+// observe records the outcome of a write
+func (m *flushMetrics) observe(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.failures.Inc()
+		return
+	}
+	m.duration.Observe(duration.Seconds())
+}
+
+// inventoryCollector exports the state of an inventory, which is read
+// whenever the metrics are collected
+type inventoryCollector struct {
+	inv            *Inventory
+	hostgroups     *prometheus.Desc
+	hosts          *prometheus.Desc
+	facts          *prometheus.Desc
+	pendingOps     *prometheus.Desc
+	lastFlush      *prometheus.Desc
+	datastoreBytes *prometheus.Desc
+}
+
+// newInventoryCollector creates the collector of the inventory
+func newInventoryCollector(inv *Inventory) *inventoryCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, nil, nil)
+	}
+	return &inventoryCollector{
+		inv:            inv,
+		hostgroups:     desc("hostgroups", "Hostgroups inside the inventory."),
+		hosts:          desc("hosts", "Hosts inside the inventory."),
+		facts:          desc("facts", "Facts set on the hosts of the inventory."),
+		pendingOps:     desc("pending_ops", "Operations which are not yet written to the datastore."),
+		lastFlush:      desc("last_flush_timestamp_seconds", "Time of the last successful write to the datastore."),
+		datastoreBytes: desc("datastore_size_bytes", "Size of the datastore on the disk."),
+	}
+}
+
+// Describe sends the descriptions of the metrics of the inventory
+func (c *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hostgroups
+	ch <- c.hosts
+	ch <- c.facts
+	ch <- c.pendingOps
+	ch <- c.lastFlush
+	ch <- c.datastoreBytes
+	if m := c.inv.flushMetrics; m != nil {
+		m.duration.Describe(ch)
+		m.failures.Describe(ch)
+	}
+}
+
+// Collect sends the current values of the metrics of the inventory
+func (c *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	hostgroups, hosts, facts := c.inv.counts()
+	ch <- prometheus.MustNewConstMetric(c.hostgroups, prometheus.GaugeValue, float64(hostgroups))
+	ch <- prometheus.MustNewConstMetric(c.hosts, prometheus.GaugeValue, float64(hosts))
+	ch <- prometheus.MustNewConstMetric(c.facts, prometheus.GaugeValue, float64(facts))
+	ch <- prometheus.MustNewConstMetric(c.pendingOps, prometheus.GaugeValue, float64(atomic.LoadUint32(&c.inv.PendingOps)))
+	lastFlush := 0.0
+	if stats := c.inv.GetFlushStats(); !stats.LastFlush.IsZero() {
+		lastFlush = float64(stats.LastFlush.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(c.lastFlush, prometheus.GaugeValue, lastFlush)
+	if info, err := os.Stat(c.inv.storePath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.datastoreBytes, prometheus.GaugeValue, float64(info.Size()))
+	}
+	if m := c.inv.flushMetrics; m != nil {
+		m.duration.Collect(ch)
+		m.failures.Collect(ch)
+	}
+}
+
+// requestMetrics records the requests served by a server
+type requestMetrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// newRequestMetrics creates the request metrics and registers them
+func newRequestMetrics(registry prometheus.Registerer) *requestMetrics {
+	m := &requestMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests served by the API.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve the requests of the API.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	registry.MustRegister(m.requests, m.latency)
+	return m
+}
+
+// statusRecorder remembers the status written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// middleware records the requests by their route, method and status
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		code := strconv.Itoa(recorder.status)
+		m.requests.WithLabelValues(route, r.Method, code).Inc()
+		m.latency.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
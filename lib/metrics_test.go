@@ -0,0 +1,93 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	server := newTestServer(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 10}, ServerOptions{
+		Tokens: []Token{{Name: "ci", Hash: HashToken("token"), Role: RoleWriter}},
+	})
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	request("POST", "/create/hostgroup", `{"hostgroup": "web"}`)
+	request("POST", "/create/host", `{"hostgroup": "web", "hostname": "web01"}`)
+	request("POST", "/create/fact", `{"hostname": "web01", "os": "linux", "cpus": 4}`)
+	request("GET", "/get/hosts/db", "")
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/get/inventory", nil))
+	time.Sleep(50 * time.Millisecond)
+
+	rec := request("GET", "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unable to scrape the metrics, got %d", rec.Code)
+	}
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`bolt_inventory_http_requests_total{code="201",method="POST",route="/create/hostgroup"} 1`,
+		`bolt_inventory_http_requests_total{code="404",method="GET",route="/get/hosts/{hostgroup}"} 1`,
+		`bolt_inventory_http_requests_total{code="401",method="GET",route="/get/inventory"} 1`,
+		`bolt_inventory_http_request_duration_seconds_count{code="201",method="POST",route="/create/fact"} 1`,
+		"bolt_inventory_hostgroups 1",
+		"bolt_inventory_hosts 1",
+		"bolt_inventory_facts 2",
+		"bolt_inventory_pending_ops 0",
+		"bolt_inventory_flush_failures_total 0",
+		"bolt_inventory_flush_duration_seconds_count ",
+		"bolt_inventory_last_flush_timestamp_seconds ",
+		"bolt_inventory_datastore_size_bytes ",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Metric %q is missing from:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, "bolt_inventory_last_flush_timestamp_seconds 0\n") {
+		t.Errorf("Successful flush was not exported")
+	}
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Metrics were served without a token, got %d", rec.Code)
+	}
+}
+
+func TestFlushMetrics(t *testing.T) {
+	t.Parallel()
+	inventory := openTestInventory(t, Options{DataStorePath: testDataStorePath(t), FlushInterval: 10})
+	store := makeFlaky(inventory)
+	if err := inventory.NewHostgroup("web"); err != nil {
+		t.Fatalf("Unable to create the hostgroup: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if failures := testutil.ToFloat64(inventory.flushMetrics.failures); failures == 0 {
+		t.Errorf("Failed writes were not counted")
+	}
+	if count := testutil.CollectAndCount(inventory.flushMetrics.duration); count != 1 {
+		t.Errorf("Flush duration histogram was not exported, got %d metrics", count)
+	}
+	atomic.StoreInt32(&store.failing, 0)
+	time.Sleep(300 * time.Millisecond)
+	if stats := inventory.GetFlushStats(); stats.Degraded() {
+		t.Fatalf("Writes did not recover, got %+v", stats)
+	}
+	before := testutil.ToFloat64(inventory.flushMetrics.failures)
+	time.Sleep(50 * time.Millisecond)
+	if after := testutil.ToFloat64(inventory.flushMetrics.failures); after != before {
+		t.Errorf("Failures were counted without pending operations, got %v after %v", after, before)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// The kinds of mutations which are recorded inside the operation log
+const (
+	opNewHostgroup            = "new_hostgroup"
+	opNewHost                 = "new_host"
+	opAddHostToHostgroup      = "add_host_to_hostgroup"
+	opRemoveHostFromHostgroup = "remove_host_from_hostgroup"
+	opDeleteHostgroup         = "delete_hostgroup"
+	opDeleteHost              = "delete_host"
+	opPurgeHost               = "purge_host"
+	opSetHostFact             = "set_host_fact"
+	opSetHostFacts            = "set_host_facts"
+	opDeleteHostFact          = "delete_host_fact"
+	opSetHostgroupVar         = "set_hostgroup_var"
+	opSetHostgroupVars        = "set_hostgroup_vars"
+	opDeleteHostgroupVar      = "delete_hostgroup_var"
+	opAddChildHostgroup       = "add_child_hostgroup"
+	opRemoveChildHostgroup    = "remove_child_hostgroup"
+)
+
+// operation describes a single mutation of the inventory. Name carries the
+// name of the fact, variable or child hostgroup the mutation is about, while
+// Values carries the facts or variables which are set together.
+type operation struct {
+	Op        string                 `json:"op"`
+	Hostgroup string                 `json:"hostgroup,omitempty"`
+	Hostname  string                 `json:"hostname,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Value     interface{}            `json:"value,omitempty"`
+	Values    map[string]interface{} `json:"values,omitempty"`
+}
+
+// opLog is an append-only log of the operations applied to the inventory
+// since the last time it was saved to the datastore. Every operation is
+// synced to the disk before it is acknowledged, so that it can be replayed
+// on top of the datastore if the service dies before the next save.
+type opLog struct {
+	f    *os.File
+	path string
+	// size is the length of the log, which marks the position of the
+	// operation appended next
+	size int64
+}
+
+// opLogPath returns the path of the operation log kept for the datastore
+func opLogPath(dataStorePath string) string {
+	return dataStorePath + ".wal"
+}
+
+// openOpLog opens the operation log for appending, creating it if needed
+func openOpLog(path string) (*opLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &opLog{f: f, path: path, size: info.Size()}, nil
+}
+
+// append writes the operation to the log and syncs it to the disk
+func (l *opLog) append(op operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	n, err := l.f.Write(append(data, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// discard drops the operations logged before the position once they are
+// part of the datastore. The operations logged after it are moved into a
+// new log which replaces the current one.
+func (l *opLog) discard(position int64) error {
+	if position >= l.size {
+		if err := l.f.Truncate(0); err != nil {
+			return err
+		}
+		l.size = 0
+		return l.f.Sync()
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < l.size {
+		return fmt.Errorf("the operation log is shorter than the %d bytes written to it", l.size)
+	}
+	tail := data[position:l.size]
+	tmpPath := l.path + ".tmp"
+	// After a successful rename the temporary file doesn't exists anymore
+	// and the removal is a no-op
+	defer os.Remove(tmpPath)
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(tail); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.size = int64(len(tail))
+	return nil
+}
+
+// close closes the operation log
+func (l *opLog) close() error {
+	return l.f.Close()
+}
+
+// attachOpLog replays the operations which didn't make it into the datastore
+// and opens the operation log for recording the upcoming operations.
+func (inv *Inventory) attachOpLog(dataStorePath string) error {
+	path := opLogPath(dataStorePath)
+	replayed, err := inv.replayOpLog(path)
+	if err != nil {
+		return &StorageError{Op: "replay the operation log", Err: err}
+	}
+	if replayed > 0 {
+		Logf(LevelInfo, "Replayed %d operations from the operation log", replayed)
+	}
+	atomic.StoreUint32(&inv.PendingOps, replayed)
+	l, err := openOpLog(path)
+	if err != nil {
+		return &StorageError{Op: "open the operation log", Err: err}
+	}
+	inv.opLog = l
+	return nil
+}
+
+// commit records the operation inside the operation log and applies it to
+// the inventory. The operation is validated first, so that only operations
+// which apply are logged, and it is only applied once the log has been
+// synced to the disk. An operation which can't be logged leaves the
+// inventory unchanged.
+func (inv *Inventory) commit(op operation) error {
+	inv.Lock()
+	defer inv.Unlock()
+	if inv.maxPendingOps > 0 && atomic.LoadUint32(&inv.PendingOps) >= inv.maxPendingOps {
+		return ErrTooManyPendingOps
+	}
+	if err := inv.validate(op); err != nil {
+		return err
+	}
+	if inv.opLog != nil {
+		if err := inv.opLog.append(op); err != nil {
+			return &StorageError{Op: "record the operation", Err: err}
+		}
+	}
+	inv.markDirty(op)
+	if err := inv.apply(op); err != nil {
+		return err
+	}
+	pending := atomic.AddUint32(&inv.PendingOps, 1)
+	if inv.FlushThreshold > 0 && pending >= inv.FlushThreshold {
+		// Wake up the flush service without waiting for it, a wakeup
+		// which is already queued covers this operation as well
+		select {
+		case inv.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// apply performs the operation on the inventory, the caller needs to hold the lock
+func (inv *Inventory) apply(op operation) error {
+	switch op.Op {
+	case opNewHostgroup:
+		_, err := inv.newHostgroup(op.Hostgroup)
+		return err
+	case opNewHost:
+		return inv.newHost(op.Hostgroup, op.Hostname)
+	case opAddHostToHostgroup:
+		return inv.addHostToHostgroup(op.Hostgroup, op.Hostname)
+	case opRemoveHostFromHostgroup:
+		return inv.removeHostFromHostgroup(op.Hostgroup, op.Hostname)
+	case opDeleteHostgroup:
+		return inv.deleteHostgroup(op.Hostgroup)
+	case opDeleteHost:
+		return inv.deleteHost(op.Hostgroup, op.Hostname)
+	case opPurgeHost:
+		return inv.purgeHost(op.Hostname)
+	case opSetHostFact:
+		return inv.setHostFact(op.Hostgroup, op.Hostname, op.Name, op.Value)
+	case opSetHostFacts:
+		return inv.setHostFacts(op.Hostgroup, op.Hostname, op.Values)
+	case opDeleteHostFact:
+		return inv.deleteHostFact(op.Hostgroup, op.Hostname, op.Name)
+	case opSetHostgroupVar:
+		return inv.setHostgroupVar(op.Hostgroup, op.Name, op.Value)
+	case opSetHostgroupVars:
+		return inv.setHostgroupVars(op.Hostgroup, op.Values)
+	case opDeleteHostgroupVar:
+		return inv.deleteHostgroupVar(op.Hostgroup, op.Name)
+	case opAddChildHostgroup:
+		return inv.addChildHostgroup(op.Hostgroup, op.Name)
+	case opRemoveChildHostgroup:
+		return inv.removeChildHostgroup(op.Hostgroup, op.Name)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// validate checks that the operation applies to the inventory without
+// changing it, returning the error apply would return. The caller needs to
+// hold the lock.
+func (inv *Inventory) validate(op operation) error {
+	switch op.Op {
+	case opNewHostgroup:
+		return inv.checkNewHostgroup(op.Hostgroup)
+	case opNewHost:
+		if err := inv.checkNewHostgroup(op.Hostgroup); err != nil {
+			return err
+		}
+		return inv.checkNewMember(op.Hostgroup, op.Hostname)
+	case opAddHostToHostgroup:
+		if inv.getHostgroup(op.Hostgroup) == nil {
+			return ErrHostgroupNotFound
+		}
+		if inv.getHost(op.Hostname) == nil {
+			return ErrHostNotFound
+		}
+		return inv.checkNewMember(op.Hostgroup, op.Hostname)
+	case opRemoveHostFromHostgroup, opDeleteHost:
+		hostgroup := inv.getHostgroup(op.Hostgroup)
+		if hostgroup == nil {
+			return ErrHostgroupNotFound
+		}
+		if hostgroup.GetHost(op.Hostname) == nil {
+			return ErrHostNotFound
+		}
+		return nil
+	case opDeleteHostgroup, opSetHostgroupVar, opSetHostgroupVars:
+		if inv.getHostgroup(op.Hostgroup) == nil {
+			return ErrHostgroupNotFound
+		}
+		return nil
+	case opPurgeHost:
+		if inv.getHost(op.Hostname) == nil {
+			return ErrHostNotFound
+		}
+		return nil
+	case opSetHostFact, opSetHostFacts:
+		_, err := inv.lookupHost(op.Hostgroup, op.Hostname)
+		return err
+	case opDeleteHostFact:
+		host, err := inv.lookupHost(op.Hostgroup, op.Hostname)
+		if err != nil {
+			return err
+		}
+		if _, ok := host.Facts[op.Name]; !ok {
+			return ErrFactNotFound
+		}
+		return nil
+	case opDeleteHostgroupVar:
+		hostgroup := inv.getHostgroup(op.Hostgroup)
+		if hostgroup == nil {
+			return ErrHostgroupNotFound
+		}
+		if _, ok := hostgroup.Vars[op.Name]; !ok {
+			return ErrVarNotFound
+		}
+		return nil
+	case opAddChildHostgroup:
+		if inv.getHostgroup(op.Hostgroup) == nil || inv.getHostgroup(op.Name) == nil {
+			return ErrHostgroupNotFound
+		}
+		if op.Hostgroup == op.Name || inv.isDescendant(op.Name, op.Hostgroup) {
+			return ErrHostgroupCycle
+		}
+		return nil
+	case opRemoveChildHostgroup:
+		hostgroup := inv.getHostgroup(op.Hostgroup)
+		if hostgroup == nil || !hostgroup.HasChild(op.Name) {
+			return ErrHostgroupNotFound
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// markDirty records the hostgroups and hosts which the operation is about
+// to change inside the changeset of the next save. It needs to run before
+// the operation is applied, since deletions cascade to hostgroups and hosts
+// which can't be found afterwards. The caller needs to hold the lock.
+func (inv *Inventory) markDirty(op operation) {
+	if inv.dirty == nil {
+		return
+	}
+	switch op.Op {
+	case opSetHostFact, opSetHostFacts, opDeleteHostFact:
+		inv.dirty.Hosts[op.Hostname] = struct{}{}
+	case opNewHost, opAddHostToHostgroup, opRemoveHostFromHostgroup, opDeleteHost:
+		inv.dirty.Hostgroups[op.Hostgroup] = struct{}{}
+		inv.dirty.Hosts[op.Hostname] = struct{}{}
+	case opDeleteHostgroup:
+		// The hosts of the hostgroup may go along with it, and it is
+		// removed from the children of its parents
+		inv.dirty.Hostgroups[op.Hostgroup] = struct{}{}
+		if hostgroup := inv.getHostgroup(op.Hostgroup); hostgroup != nil {
+			for hostname := range hostgroup.Hosts {
+				inv.dirty.Hosts[hostname] = struct{}{}
+			}
+		}
+		for hgname, hostgroup := range inv.Hostgroups {
+			for _, child := range hostgroup.Children {
+				if child == op.Hostgroup {
+					inv.dirty.Hostgroups[hgname] = struct{}{}
+				}
+			}
+		}
+	case opPurgeHost:
+		inv.dirty.Hosts[op.Hostname] = struct{}{}
+		for hgname, hostgroup := range inv.Hostgroups {
+			if _, ok := hostgroup.Hosts[op.Hostname]; ok {
+				inv.dirty.Hostgroups[hgname] = struct{}{}
+			}
+		}
+	default:
+		inv.dirty.Hostgroups[op.Hostgroup] = struct{}{}
+	}
+}
+
+// replayOpLog applies the operations recorded in the log at the path on top
+// of the inventory and returns the number of replayed operations. Operations
+// which no longer apply, because the datastore was saved right before the
+// log could be truncated, are skipped. A partially written last operation is
+// never acknowledged and is hence dropped as well. It is also cut off from
+// the log, so that the upcoming operations aren't appended to it.
+func (inv *Inventory) replayOpLog(path string) (uint32, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	inv.Lock()
+	defer inv.Unlock()
+	var replayed uint32
+	// complete is the end of the last completely written operation
+	var complete int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				Logf(LevelWarning, "dropping a partially written operation from %s", path)
+				if err := f.Truncate(complete); err != nil {
+					return replayed, err
+				}
+				if err := f.Sync(); err != nil {
+					return replayed, err
+				}
+			}
+			return replayed, nil
+		} else if err != nil {
+			return replayed, err
+		}
+		complete += int64(len(line))
+		var op operation
+		if err := decodeJSON(line, &op); err != nil {
+			return replayed, fmt.Errorf("corrupt operation log %s: %s", path, err)
+		}
+		inv.markDirty(op)
+		if err := inv.apply(op); err != nil {
+			Logf(LevelWarning, "Skipping the operation %s while replaying: %s", op.Op, err)
+			continue
+		}
+		replayed++
+	}
+}
@@ -0,0 +1,232 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newLoggedInventory returns an inventory recording its operations inside
+// the operation log of the datastore, without starting the flush service.
+func newLoggedInventory(t *testing.T, dataStorePath string) *Inventory {
+	inventory := newTestInventory()
+	inventory.DataStorePath = dataStorePath
+	inventory.store, _ = openJSONStore(dataStorePath)
+	if err := inventory.attachOpLog(dataStorePath); err != nil {
+		t.Fatalf("Unable to attach the operation log: %s", err)
+	}
+	return inventory
+}
+
+func TestReplayOpLog(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHost("web", "m1.example.com")
+	inventory.NewHost("web", "m2.example.com")
+	inventory.SetHostFact("web", "m1.example.com", "cpus", 4)
+	inventory.SetHostgroupVar("web", "port", 8080)
+	inventory.DeleteHost("web", "m2.example.com")
+	// Simulate a crash, the datastore was never saved
+	inventory.opLog.close()
+
+	reloaded := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 1000})
+	defer reloaded.StopInventory()
+	host := reloaded.GetHost("m1.example.com")
+	if host == nil || host.Facts["cpus"] == nil {
+		t.Fatalf("Operations were not replayed from the operation log")
+	}
+	if reloaded.GetHost("m2.example.com") != nil {
+		t.Errorf("Deleted host came back after replay")
+	}
+	if v := reloaded.GetHostgroup("web").GetVars()["port"]; v == nil {
+		t.Errorf("Hostgroup variable was not replayed")
+	}
+}
+
+func TestReplayOpLogPartialOperation(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHostgroup("web")
+	inventory.opLog.close()
+
+	f, _ := os.OpenFile(opLogPath(dataStorePath), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"op":"new_hostgroup","hostgr`))
+	f.Close()
+
+	reloaded := newTestInventory()
+	replayed, err := reloaded.replayOpLog(opLogPath(dataStorePath))
+	if err != nil {
+		t.Fatalf("Partial operation should be dropped, got %s", err)
+	}
+	if replayed != 1 || reloaded.GetHostgroup("web") == nil {
+		t.Errorf("Expected a single replayed operation, got %d", replayed)
+	}
+}
+
+func TestRestartAfterPartialOperation(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHostgroup("web")
+	inventory.opLog.close()
+	f, _ := os.OpenFile(opLogPath(dataStorePath), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"op":"new_hostgr`))
+	f.Close()
+
+	// The operation acknowledged after the restart follows the last
+	// complete one instead of the dropped fragment
+	restarted := newLoggedInventory(t, dataStorePath)
+	if err := restarted.NewHostgroup("db"); err != nil {
+		t.Fatalf("Unable to create the hostgroup: %s", err)
+	}
+	restarted.opLog.close()
+
+	reloaded := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 1000})
+	defer reloaded.StopInventory()
+	if reloaded.GetHostgroup("web") == nil || reloaded.GetHostgroup("db") == nil {
+		t.Errorf("Acknowledged operations were lost after the restart, got %v", reloaded.GetInventory())
+	}
+}
+
+func TestSaveTruncatesOpLog(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	defer inventory.opLog.close()
+	inventory.NewHost("web", "m1.example.com")
+	inventory.Save()
+	data, err := ioutil.ReadFile(opLogPath(dataStorePath))
+	if err != nil || len(data) != 0 {
+		t.Errorf("Operation log was not truncated after saving, got %q", data)
+	}
+	if inventory.PendingOps != 0 {
+		t.Errorf("Pending operations were not reset after saving")
+	}
+}
+
+// blockingStore holds the saves until it is released
+type blockingStore struct {
+	Store
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Save(inv *Inventory, changes *Changeset) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.Store.Save(inv, changes)
+}
+
+func TestOperationsDuringSave(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHost("web", "m1.example.com")
+	store := &blockingStore{Store: inventory.store, saving: make(chan struct{}), release: make(chan struct{})}
+	inventory.store = store
+	saved := make(chan error)
+	go func() { saved <- inventory.Save() }()
+	<-store.saving
+
+	// The inventory stays available while the datastore is being written
+	done := make(chan error)
+	go func() { done <- inventory.NewHost("db", "m2.example.com") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unable to add the host during the save: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Operation was blocked by the save")
+	}
+	if inventory.GetHost("m1.example.com") == nil {
+		t.Errorf("Inventory was not readable during the save")
+	}
+	close(store.release)
+	if err := <-saved; err != nil {
+		t.Fatalf("Unable to save the inventory: %s", err)
+	}
+	if pending := atomic.LoadUint32(&inventory.PendingOps); pending != 1 {
+		t.Errorf("Operation logged during the save should be pending, got %d", pending)
+	}
+	// Simulate a crash, the operation logged during the save is replayed
+	inventory.opLog.close()
+	reloaded := openTestInventory(t, Options{DataStorePath: dataStorePath, FlushInterval: 1000})
+	defer reloaded.StopInventory()
+	if reloaded.GetHost("m1.example.com") == nil || reloaded.GetHost("m2.example.com") == nil {
+		t.Errorf("Hosts were lost across the save")
+	}
+	if pending := atomic.LoadUint32(&reloaded.PendingOps); pending != 1 {
+		t.Errorf("Expected the operation logged during the save to be replayed, got %d", pending)
+	}
+}
+
+func TestCommitOnlyLoggedOperations(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHostgroup("web")
+	if err := inventory.DeleteHostgroup("db"); err != ErrHostgroupNotFound {
+		t.Fatalf("Expected ErrHostgroupNotFound, got %v", err)
+	}
+	data, _ := ioutil.ReadFile(opLogPath(dataStorePath))
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Failed operation was logged, got %q", data)
+	}
+
+	// Operations which can't be logged are not applied
+	inventory.opLog.close()
+	err := inventory.SetHostgroupVar("web", "port", 8080)
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) {
+		t.Fatalf("Expected a StorageError, got %v", err)
+	}
+	if _, ok := inventory.GetHostgroup("web").GetVars()["port"]; ok {
+		t.Errorf("Operation which couldn't be logged was applied")
+	}
+	if inventory.PendingOps != 1 {
+		t.Errorf("Operation which couldn't be logged is pending, got %d", inventory.PendingOps)
+	}
+}
+
+func TestSetFactsAsOneOperation(t *testing.T) {
+	dataStorePath := testDataStorePath(t)
+	inventory := newLoggedInventory(t, dataStorePath)
+	inventory.NewHost("web", "m1.example.com")
+	facts := map[string]interface{}{"os": "linux", "cpus": 4, "ram": "16G"}
+	if err := inventory.SetHostFacts("web", "m1.example.com", facts); err != nil {
+		t.Fatalf("Unable to set the facts: %s", err)
+	}
+	if err := inventory.SetHostgroupVars("web", map[string]interface{}{"port": 8080, "tls": true}); err != nil {
+		t.Fatalf("Unable to set the variables: %s", err)
+	}
+	if inventory.PendingOps != 3 {
+		t.Errorf("Expected the facts and the variables to be single operations, got %d", inventory.PendingOps)
+	}
+	data, _ := ioutil.ReadFile(opLogPath(dataStorePath))
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("Expected 3 logged operations, got %q", data)
+	}
+
+	// None of the facts is set if the operation can't be logged
+	inventory.opLog.close()
+	inventory.SetHostFacts("web", "m1.example.com", map[string]interface{}{"os": "bsd", "disk": "1T"})
+	host := inventory.GetHost("m1.example.com")
+	if host.Facts["os"] != "linux" || host.Facts["disk"] != nil {
+		t.Errorf("Facts were partially set, got %v", host.Facts)
+	}
+
+	reloaded := newTestInventory()
+	if _, err := reloaded.replayOpLog(opLogPath(dataStorePath)); err != nil {
+		t.Fatalf("Unable to replay the operation log: %s", err)
+	}
+	if host := reloaded.GetHost("m1.example.com"); host == nil || len(host.Facts) != 3 {
+		t.Errorf("Facts were not replayed, got %v", host)
+	}
+	if vars := reloaded.GetHostgroup("web").GetVars(); len(vars) != 2 {
+		t.Errorf("Variables were not replayed, got %v", vars)
+	}
+}
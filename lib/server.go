@@ -0,0 +1,136 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ServerOptions defines the settings with which the API is served
+type ServerOptions struct {
+	// Tokens grants access to the API. Without tokens, the API is open.
+	Tokens []Token
+	// PathPrefix mounts the API under the path, such as /inventory, so
+	// that it can be served next to other handlers
+	PathPrefix string
+	// Logger receives the messages and the access log of the server. The
+	// package logger is used if it isn't set.
+	Logger *Logger
+}
+
+// Server serves the API of a single inventory. Any number of servers can
+// be used inside the same process, each with its own inventory. The server
+// doesn't own the inventory, which needs to be closed by the caller once
+// the server no longer serves any requests.
+type Server struct {
+	inv    *Inventory
+	opts   ServerOptions
+	logger *Logger
+	auth   *authenticator
+	router *mux.Router
+	// handler logs the requests before routing them
+	handler http.Handler
+	// registry holds the metrics of the server and its inventory, which
+	// are served at /metrics
+	registry *prometheus.Registry
+	metrics  *requestMetrics
+}
+
+// NewServer creates the server of the API of the inventory
+func NewServer(inv *Inventory, opts ServerOptions) (*Server, error) {
+	auth, err := newAuthenticator(opts.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token configuration: %s", err)
+	}
+	if opts.PathPrefix != "" && (!strings.HasPrefix(opts.PathPrefix, "/") || strings.HasSuffix(opts.PathPrefix, "/")) {
+		return nil, fmt.Errorf("PathPrefix needs to start with a slash and not end with one, got %q", opts.PathPrefix)
+	}
+	s := &Server{inv: inv, opts: opts, logger: opts.Logger, auth: auth}
+	if s.logger == nil {
+		s.logger = defaultLogger
+	}
+	auth.logger = s.logger
+	auth.inv = inv
+	auth.pingPath = opts.PathPrefix + "/ping"
+	s.registry = prometheus.NewRegistry()
+	s.registry.MustRegister(newInventoryCollector(inv))
+	s.metrics = newRequestMetrics(s.registry)
+	s.router = mux.NewRouter()
+	s.router.NotFoundHandler = http.HandlerFunc(notFound)
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router := s.router
+	if opts.PathPrefix != "" {
+		router = s.router.PathPrefix(opts.PathPrefix).Subrouter()
+	}
+	s.routes(router)
+	// Without any tokens the API stays open, as it was before the tokens
+	// were introduced. The middleware is installed regardless, so that the
+	// tokens can be added through SetTokens.
+	s.warnOpenAPI(opts.Tokens)
+	// The requests are counted before the authentication, so that the
+	// rejected ones show up as well
+	router.Use(s.metrics.middleware)
+	router.Use(auth.middleware)
+	// The access log wraps the router, so that the requests which don't
+	// match any route are logged as well
+	s.handler = s.accessLog(s.router)
+	return s, nil
+}
+
+// routes maps the endpoints to the handlers
+func (s *Server) routes(router *mux.Router) {
+	router.HandleFunc("/ping", ping).Methods("GET")
+	router.HandleFunc("/status", s.getStatus).Methods("GET")
+	router.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{})).Methods("GET")
+	router.HandleFunc("/create/hostgroup", s.createHostgroup).Methods("POST")
+	router.HandleFunc("/create/host", s.createHost).Methods("POST")
+	router.HandleFunc("/create/membership", s.addHostToHostgroup).Methods("POST")
+	router.HandleFunc("/create/fact", s.setHostFact).Methods("POST")
+	router.HandleFunc("/create/groupvar", s.setHostgroupVar).Methods("POST")
+	router.HandleFunc("/create/child", s.addChildHostgroup).Methods("POST")
+	router.HandleFunc("/get/inventory", s.getInventory).Methods("GET")
+	router.HandleFunc("/get/hosts/{hostgroup}", s.getHosts).Methods("GET")
+	router.HandleFunc("/get/host/{hostname}", s.getHostVars).Methods("GET")
+	router.HandleFunc("/delete/hostgroup/{hostgroup}", s.deleteHostgroup).Methods("DELETE")
+	router.HandleFunc("/delete/host/{hostname}", s.purgeHost).Methods("DELETE")
+	router.HandleFunc("/delete/host/{hostgroup}/{hostname}", s.deleteHost).Methods("DELETE")
+	router.HandleFunc("/delete/membership/{hostgroup}/{hostname}", s.removeHostFromHostgroup).Methods("DELETE")
+	router.HandleFunc("/delete/fact/{hostgroup}/{hostname}/{fact}", s.deleteHostFact).Methods("DELETE")
+	router.HandleFunc("/delete/groupvar/{hostgroup}/{var}", s.deleteHostgroupVar).Methods("DELETE")
+	router.HandleFunc("/delete/child/{hostgroup}/{child}", s.removeChildHostgroup).Methods("DELETE")
+}
+
+// ServeHTTP serves the API requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Inventory returns the inventory served by the server
+func (s *Server) Inventory() *Inventory {
+	return s.inv
+}
+
+// SetTokens replaces the tokens which grant access to the API while the
+// requests are being served. Invalid tokens leave the current ones in place.
+func (s *Server) SetTokens(tokens []Token) error {
+	if err := s.auth.setTokens(tokens); err != nil {
+		return fmt.Errorf("invalid token configuration: %s", err)
+	}
+	s.warnOpenAPI(tokens)
+	return nil
+}
+
+// warnOpenAPI warns that the API is served without authentication
+func (s *Server) warnOpenAPI(tokens []Token) {
+	if len(tokens) == 0 {
+		s.logger.Logf(LevelWarning, "no tokens configured, the API is served without authentication")
+	}
+}
@@ -0,0 +1,365 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	// registers the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations holds the versioned schema of the SQLite store. The
+// migration at index i brings the schema to version i+1, new migrations
+// are only ever appended to the list.
+var sqliteMigrations = []string{
+	`CREATE TABLE hostgroups (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE hosts (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE memberships (
+		hostgroup TEXT NOT NULL REFERENCES hostgroups(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		hostname TEXT NOT NULL REFERENCES hosts(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		PRIMARY KEY (hostgroup, hostname)
+	);
+	CREATE TABLE facts (
+		hostname TEXT NOT NULL REFERENCES hosts(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (hostname, name)
+	);
+	CREATE TABLE hostgroup_vars (
+		hostgroup TEXT NOT NULL REFERENCES hostgroups(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (hostgroup, name)
+	);
+	CREATE TABLE hostgroup_children (
+		parent TEXT NOT NULL REFERENCES hostgroups(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		child TEXT NOT NULL REFERENCES hostgroups(name) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+		PRIMARY KEY (parent, child)
+	);
+	CREATE INDEX memberships_hostname ON memberships(hostname);
+	CREATE INDEX facts_name ON facts(name);`,
+	// meta records the details of the database itself. A database which
+	// already holds an inventory was imported before the import was recorded.
+	`CREATE TABLE meta (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	INSERT INTO meta (name, value) SELECT 'imported', CURRENT_TIMESTAMP
+		WHERE EXISTS (SELECT 1 FROM hostgroups) OR EXISTS (SELECT 1 FROM hosts);`,
+}
+
+// sqliteStore keeps the inventory inside the tables of a SQLite database.
+// Facts and variables are stored as JSON encoded values.
+type sqliteStore struct {
+	path string
+	db   *sql.DB
+	// importPath is the JSON datastore which is imported into the database
+	// until the import completed once
+	importPath string
+}
+
+// openSQLiteStore opens the SQLite database at the path, creating it and
+// bringing its schema to the latest version if needed. The inventory is
+// imported from the JSON datastore at the importPath until the import
+// completed once.
+func openSQLiteStore(path string, importPath string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes the access to the database file
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{path: path, db: db}
+	if path != importPath {
+		s.importPath = importPath
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations which are missing from the database, each
+// inside its own transaction.
+func (s *sqliteStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("the database %s has the schema version %d which is newer than the supported %d",
+			s.path, version, len(sqliteMigrations))
+	}
+	for v := version + 1; v <= len(sqliteMigrations); v++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[v-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to migrate the schema to version %d: %s", v, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", v); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		Logf(LevelInfo, "Migrated the database %s to the schema version %d", s.path, v)
+	}
+	return nil
+}
+
+// Load reads the inventory from the tables. A database which didn't complete
+// the import yet is populated from the JSON datastore if there is one.
+func (s *sqliteStore) Load() (*Inventory, error) {
+	var imported int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM meta WHERE name = 'imported'").Scan(&imported); err != nil {
+		return nil, err
+	}
+	if imported == 0 {
+		inv, err := importDatastore(s.importPath, s.saveImport)
+		if err != nil || inv != nil {
+			return inv, err
+		}
+	}
+	return s.load()
+}
+
+// load reads the inventory from the tables
+func (s *sqliteStore) load() (*Inventory, error) {
+	inv := &Inventory{
+		Hostgroups:    make(map[string]*HostGroup),
+		Hosts:         make(map[string]*Host),
+		DataStorePath: s.path,
+	}
+	err := s.query("SELECT name FROM hosts", func(rows *sql.Rows) error {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		inv.Hosts[name] = NewHost(name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.query("SELECT name FROM hostgroups", func(rows *sql.Rows) error {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		inv.Hostgroups[name] = NewHostGroup(name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Hostgroups) == 0 && len(inv.Hosts) == 0 {
+		return nil, nil
+	}
+	err = s.query("SELECT hostname, name, value FROM facts", func(rows *sql.Rows) error {
+		var hostname, name, value string
+		if err := rows.Scan(&hostname, &name, &value); err != nil {
+			return err
+		}
+		var v interface{}
+		if err := decodeJSON([]byte(value), &v); err != nil {
+			return fmt.Errorf("corrupt fact %s of the host %s: %s", name, hostname, err)
+		}
+		inv.Hosts[hostname].SetFact(name, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.query("SELECT hostgroup, name, value FROM hostgroup_vars", func(rows *sql.Rows) error {
+		var hostgroup, name, value string
+		if err := rows.Scan(&hostgroup, &name, &value); err != nil {
+			return err
+		}
+		var v interface{}
+		if err := decodeJSON([]byte(value), &v); err != nil {
+			return fmt.Errorf("corrupt variable %s of the hostgroup %s: %s", name, hostgroup, err)
+		}
+		inv.Hostgroups[hostgroup].SetVar(name, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.query("SELECT hostgroup, hostname FROM memberships", func(rows *sql.Rows) error {
+		var hostgroup, hostname string
+		if err := rows.Scan(&hostgroup, &hostname); err != nil {
+			return err
+		}
+		inv.Hostgroups[hostgroup].AddHost(inv.Hosts[hostname])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.query("SELECT parent, child FROM hostgroup_children ORDER BY parent, child", func(rows *sql.Rows) error {
+		var parent, child string
+		if err := rows.Scan(&parent, &child); err != nil {
+			return err
+		}
+		hostgroup := inv.Hostgroups[parent]
+		hostgroup.Children = append(hostgroup.Children, child)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// query runs the query and calls scan for every returned row
+func (s *sqliteStore) query(query string, scan func(rows *sql.Rows) error) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Save rewrites the rows of the changed hostgroups and hosts inside a single
+// transaction. The rows of the deleted ones are removed along with
+// everything referencing them.
+func (s *sqliteStore) Save(inv *Inventory, changes *Changeset) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.saveChanges(tx, inv, changes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveImport writes the imported inventory and records that the import is
+// complete inside a single transaction
+func (s *sqliteStore) saveImport(inv *Inventory, changes *Changeset) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.saveChanges(tx, inv, changes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO meta (name, value) VALUES ('imported', CURRENT_TIMESTAMP)"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveChanges writes the changeset using the transaction
+func (s *sqliteStore) saveChanges(tx *sql.Tx, inv *Inventory, changes *Changeset) error {
+	for hostname := range changes.Hosts {
+		host, ok := inv.Hosts[hostname]
+		if !ok {
+			if _, err := tx.Exec("DELETE FROM hosts WHERE name = ?", hostname); err != nil {
+				return err
+			}
+			continue
+		}
+		// INSERT OR REPLACE would delete the row first and cascade the
+		// deletion to the memberships of the host
+		if _, err := tx.Exec("INSERT OR IGNORE INTO hosts (name) VALUES (?)", hostname); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM facts WHERE hostname = ?", hostname); err != nil {
+			return err
+		}
+		for name, value := range host.Facts {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO facts (hostname, name, value) VALUES (?, ?, ?)", hostname, name, string(data))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for hgname := range changes.Hostgroups {
+		hostgroup, ok := inv.Hostgroups[hgname]
+		if !ok {
+			if _, err := tx.Exec("DELETE FROM hostgroups WHERE name = ?", hgname); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO hostgroups (name) VALUES (?)", hgname); err != nil {
+			return err
+		}
+		for _, table := range []string{"memberships", "hostgroup_vars"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE hostgroup = ?", hgname); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM hostgroup_children WHERE parent = ?", hgname); err != nil {
+			return err
+		}
+		for hostname := range hostgroup.Hosts {
+			_, err := tx.Exec("INSERT INTO memberships (hostgroup, hostname) VALUES (?, ?)", hgname, hostname)
+			if err != nil {
+				return err
+			}
+		}
+		for name, value := range hostgroup.Vars {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO hostgroup_vars (hostgroup, name, value) VALUES (?, ?, ?)", hgname, name, string(data))
+			if err != nil {
+				return err
+			}
+		}
+		for _, child := range hostgroup.Children {
+			_, err := tx.Exec("INSERT INTO hostgroup_children (parent, child) VALUES (?, ?)", hgname, child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// savesChangesOnly marks the store as reading only the changed hostgroups
+// and hosts
+func (s *sqliteStore) savesChangesOnly() {}
+
+// Close closes the database
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
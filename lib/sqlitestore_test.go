@@ -0,0 +1,135 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sqliteTestOptions provides the options of a SQLite store kept next to
+// a JSON datastore inside the test directory
+func sqliteTestOptions(t *testing.T) Options {
+	dataStorePath := testDataStorePath(t)
+	return Options{
+		Backend:       BackendSQLite,
+		BackendPath:   filepath.Join(filepath.Dir(dataStorePath), "inventory.sqlite"),
+		DataStorePath: dataStorePath,
+		FlushInterval: 60000,
+	}
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	opts := sqliteTestOptions(t)
+	inventory := openTestInventory(t, opts)
+	inventory.NewHost("web", "m1.example.com")
+	inventory.NewHost("web", "m2.example.com")
+	inventory.NewHost("db", "m1.example.com")
+	inventory.SetHostFact("", "m1.example.com", "cpus", 4)
+	inventory.SetHostFact("", "m1.example.com", "disks", []interface{}{"sda", "sdb"})
+	inventory.SetHostgroupVar("web", "port", 8080)
+	inventory.NewHostgroup("prod")
+	inventory.AddChildHostgroup("prod", "web")
+	inventory.Save()
+	inventory.PurgeHost("m2.example.com")
+	inventory.DeleteHostgroup("db")
+	inventory.StopInventory()
+
+	store, err := OpenStore(opts)
+	if err != nil {
+		t.Fatalf("Unable to reopen the store: %s", err)
+	}
+	defer store.Close()
+	reloaded, err := store.Load()
+	if err != nil || reloaded == nil {
+		t.Fatalf("Unable to load the inventory: %v", err)
+	}
+	if len(reloaded.Hostgroups) != 2 || reloaded.Hostgroups["db"] != nil {
+		t.Errorf("Deleted hostgroup was not removed from the store")
+	}
+	host := reloaded.Hosts["m1.example.com"]
+	if len(reloaded.Hosts) != 1 || host == nil || host.Facts["cpus"].(interface{ String() string }).String() != "4" {
+		t.Fatalf("Hosts were not persisted correctly, got %v", reloaded.Hosts)
+	}
+	if disks, ok := host.Facts["disks"].([]interface{}); !ok || len(disks) != 2 {
+		t.Errorf("Structured fact was not persisted, got %v", host.Facts["disks"])
+	}
+	if reloaded.Hostgroups["web"].Hosts["m1.example.com"] != host {
+		t.Errorf("Reloaded host is not linked with the host registry")
+	}
+	if reloaded.Hostgroups["web"].Vars["port"] == nil {
+		t.Errorf("Hostgroup variable was not persisted")
+	}
+	if children := reloaded.Hostgroups["prod"].Children; len(children) != 1 || children[0] != "web" {
+		t.Errorf("Children were not persisted, got %v", children)
+	}
+	var memberships int
+	store.(*sqliteStore).db.QueryRow("SELECT COUNT(*) FROM memberships WHERE hostname = ?", "m1.example.com").Scan(&memberships)
+	if memberships != 1 {
+		t.Errorf("Memberships of the deleted hostgroup were kept, got %d", memberships)
+	}
+}
+
+func TestSQLiteStoreMigrations(t *testing.T) {
+	opts := sqliteTestOptions(t)
+	for i := 0; i < 2; i++ {
+		store, err := OpenStore(opts)
+		if err != nil {
+			t.Fatalf("Unable to open the store: %s", err)
+		}
+		var version int
+		store.(*sqliteStore).db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+		if version != len(sqliteMigrations) {
+			t.Errorf("Schema was not migrated to the latest version, got %d", version)
+		}
+		store.Close()
+	}
+}
+
+func TestSQLiteStoreImport(t *testing.T) {
+	opts := sqliteTestOptions(t)
+	legacy := openTestInventory(t, Options{DataStorePath: opts.DataStorePath, FlushInterval: 60000})
+	legacy.NewHost("web", "m1.example.com")
+	legacy.SetHostFact("web", "m1.example.com", "cpus", 4)
+	legacy.StopInventory()
+
+	inventory := openTestInventory(t, opts)
+	if inventory.GetHost("m1.example.com") == nil {
+		t.Fatalf("JSON datastore was not imported on the first run")
+	}
+	inventory.PurgeHost("m1.example.com")
+	inventory.Close()
+
+	// The JSON datastore is only imported until the import completed once
+	store, _ := OpenStore(opts)
+	defer store.Close()
+	reloaded, err := store.Load()
+	if err != nil || reloaded == nil || reloaded.Hostgroups["web"] == nil {
+		t.Fatalf("Unable to load the inventory: %v", err)
+	}
+	if reloaded.Hosts["m1.example.com"] != nil {
+		t.Errorf("JSON datastore was imported again")
+	}
+}
+
+func TestSQLiteStoreImportRetry(t *testing.T) {
+	opts := sqliteTestOptions(t)
+	ioutil.WriteFile(opts.DataStorePath, []byte(`{"Hostgroups": {`), 0644)
+	if _, err := Open(opts); err == nil {
+		t.Fatalf("Corrupt JSON datastore was imported")
+	}
+
+	// The failed import is retried once the datastore is repaired
+	os.Remove(opts.DataStorePath)
+	legacy := openTestInventory(t, Options{DataStorePath: opts.DataStorePath, FlushInterval: 60000})
+	legacy.NewHost("web", "m1.example.com")
+	legacy.StopInventory()
+	inventory := openTestInventory(t, opts)
+	defer inventory.Close()
+	if inventory.GetHost("m1.example.com") == nil {
+		t.Errorf("JSON datastore was not imported after the failed import")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyrights 2018 Saurabh Badhwar.
+// The use of this package is governed by MIT License
+// which can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"fmt"
+)
+
+// The storage backends which can hold the inventory
+const (
+	// BackendJSON keeps the complete inventory as a single JSON document
+	BackendJSON = "json"
+	// BackendBolt keeps every hostgroup and host under its own key inside
+	// an embedded bbolt database
+	BackendBolt = "bolt"
+	// BackendSQLite keeps the inventory inside the tables of a SQLite
+	// database, so that it can be queried with SQL
+	BackendSQLite = "sqlite"
+)
+
+// Store defines the persistent storage of the inventory
+type Store interface {
+	// Load reads the inventory kept inside the store. A store which doesn't
+	// hold an inventory yet returns a nil inventory without an error.
+	Load() (*Inventory, error)
+	// Save persists the inventory. The changeset names the hostgroups and
+	// hosts which changed since the last save, which allows the store to
+	// write only those. The inventory is a snapshot owned by the store, so
+	// no lock is needed.
+	Save(inv *Inventory, changes *Changeset) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Changeset names the hostgroups and hosts which changed since the last time
+// the inventory was saved. A name which is no longer part of the inventory
+// was deleted.
+type Changeset struct {
+	Hostgroups map[string]struct{}
+	Hosts      map[string]struct{}
+}
+
+// newChangeset returns an empty changeset
+func newChangeset() *Changeset {
+	return &Changeset{Hostgroups: make(map[string]struct{}), Hosts: make(map[string]struct{})}
+}
+
+// merge adds the names of the other changeset
+func (c *Changeset) merge(other *Changeset) {
+	for name := range other.Hostgroups {
+		c.Hostgroups[name] = struct{}{}
+	}
+	for name := range other.Hosts {
+		c.Hosts[name] = struct{}{}
+	}
+}
+
+// changesOnlyStore is implemented by the stores which only read the changed
+// hostgroups and hosts of the inventory they save, so that the snapshot
+// handed to them can leave out the others
+type changesOnlyStore interface {
+	savesChangesOnly()
+}
+
+// OpenStore opens the store of the backend selected by the options. An empty
+// backend selects the JSON datastore. The other backends keep their database
+// at the BackendPath, which is required, and import the JSON datastore until
+// the import completed once.
+func OpenStore(opts Options) (Store, error) {
+	switch opts.Backend {
+	case "", BackendJSON:
+		return openJSONStore(opts.DataStorePath)
+	case BackendBolt, BackendSQLite:
+		if opts.BackendPath == "" {
+			return nil, fmt.Errorf("BackendPath is required by the %s backend", opts.Backend)
+		}
+		if opts.Backend == BackendBolt {
+			return openBoltStore(opts.BackendPath, opts.DataStorePath)
+		}
+		return openSQLiteStore(opts.BackendPath, opts.DataStorePath)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", opts.Backend)
+}
+
+// importDatastore copies the inventory from the JSON datastore at the path
+// into a store which wasn't populated yet, so that switching the backend
+// keeps the inventory. The save writes the imported inventory along with the
+// record that the import is complete, so that a failed import is retried on
+// the next start. A missing datastore completes the import with an empty
+// store.
+func importDatastore(path string, save func(inv *Inventory, changes *Changeset) error) (*Inventory, error) {
+	inv := &Inventory{Hostgroups: make(map[string]*HostGroup), Hosts: make(map[string]*Host)}
+	if path != "" && checkDatastorePath(path) {
+		loaded, err := loadDatastore(path)
+		if err != nil {
+			return nil, err
+		}
+		if loaded != nil {
+			inv = loaded
+		}
+	}
+	changes := newChangeset()
+	for hgname := range inv.Hostgroups {
+		changes.Hostgroups[hgname] = struct{}{}
+	}
+	for hostname := range inv.Hosts {
+		changes.Hosts[hostname] = struct{}{}
+	}
+	if err := save(inv, changes); err != nil {
+		return nil, fmt.Errorf("unable to import the datastore %s: %s", path, err)
+	}
+	if len(inv.Hostgroups) == 0 && len(inv.Hosts) == 0 {
+		return nil, nil
+	}
+	Logf(LevelInfo, "Imported %d hostgroups and %d hosts from the datastore %s",
+		len(inv.Hostgroups), len(inv.Hosts), path)
+	return inv, nil
+}
+
+// jsonStore keeps the inventory as a single JSON document which is rewritten
+// on every save.
+type jsonStore struct {
+	path string
+}
+
+// openJSONStore opens the JSON datastore, creating it if it doesn't exist
+func openJSONStore(path string) (*jsonStore, error) {
+	if !checkDatastorePath(path) {
+		if _, err := createDatastore(path); err != nil {
+			return nil, err
+		}
+	}
+	return &jsonStore{path: path}, nil
+}
+
+// Load reads the inventory, falling back to the backups of the datastore
+func (s *jsonStore) Load() (*Inventory, error) {
+	return loadDatastore(s.path)
+}
+
+// Save rewrites the complete datastore, the changeset is not needed for it
+func (s *jsonStore) Save(inv *Inventory, changes *Changeset) error {
+	jsonData, err := inv.toJSON()
+	if err != nil {
+		return fmt.Errorf("unable to convert the data into valid JSON: %s", err)
+	}
+	return writeDatastore(s.path, jsonData)
+}
+
+// Close is a no-op since the datastore is only opened while being accessed
+func (s *jsonStore) Close() error {
+	return nil
+}